@@ -0,0 +1,58 @@
+package kademila
+
+import (
+	"crypto/sha1"
+	"math"
+	"net"
+)
+
+// BEP 33 bloom filter: 2048 bits, 2 hash functions over the SHA-1 of the
+// compact IP address.
+const (
+	BloomFilterSize = 256 // bytes
+	bloomFilterBits = BloomFilterSize * 8
+)
+
+type bloomFilter []byte
+
+func newBloomFilter() bloomFilter {
+	return make(bloomFilter, BloomFilterSize)
+}
+
+func (bf bloomFilter) add(ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	hash := sha1.Sum(ip)
+	index1 := (int(hash[0]) | int(hash[1])<<8) % bloomFilterBits
+	index2 := (int(hash[2]) | int(hash[3])<<8) % bloomFilterBits
+	bf[index1/8] |= 1 << uint(index1%8)
+	bf[index2/8] |= 1 << uint(index2%8)
+}
+
+func (bf bloomFilter) merge(other []byte) {
+	if len(other) != BloomFilterSize {
+		return
+	}
+	for i := range bf {
+		bf[i] |= other[i]
+	}
+}
+
+// estimate returns the approximate number of distinct addresses in the filter.
+func (bf bloomFilter) estimate() int {
+	zero := 0
+	for _, b := range bf {
+		for i := uint(0); i < 8; i++ {
+			if b&(1<<i) == 0 {
+				zero++
+			}
+		}
+	}
+	if zero == 0 {
+		zero = 1 // saturated
+	}
+	m := float64(bloomFilterBits)
+	n := math.Log(float64(zero)/m) / (2 * math.Log(1-1/m))
+	return int(n + 0.5)
+}
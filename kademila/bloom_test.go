@@ -0,0 +1,70 @@
+package kademila
+
+import (
+	"net"
+	"testing"
+)
+
+// bep33Filter returns the filter of the BEP 33 example, 192.0.2.0 to
+// 192.0.2.255 and 2001:db8:: to 2001:db8::3e7.
+func bep33Filter() bloomFilter {
+	bf := newBloomFilter()
+	for i := 0; i < 256; i++ {
+		bf.add(net.IPv4(192, 0, 2, byte(i)))
+	}
+	ip := net.ParseIP("2001:db8::")
+	for i := 0; i < 1000; i++ {
+		ip[14], ip[15] = byte(i>>8), byte(i)
+		bf.add(ip)
+	}
+	return bf
+}
+
+func TestBloomFilterEstimate(t *testing.T) {
+	half := newBloomFilter()
+	for i := 0; i < 100; i++ {
+		half.add(net.IPv4(10, 0, 0, byte(i)))
+	}
+	full := newBloomFilter()
+	for i := range full {
+		full[i] = 0xff
+	}
+	tests := []struct {
+		name string
+		bf   bloomFilter
+		want int
+		// Allowed error
+		delta int
+	}{
+		{"empty", newBloomFilter(), 0, 0},
+		// 1224.93 in BEP 33
+		{"BEP 33 example", bep33Filter(), 1225, 0},
+		{"100 addresses", half, 100, 5},
+		{"saturated", full, 7806, 0},
+	}
+	for _, test := range tests {
+		got := test.bf.estimate()
+		if got < test.want-test.delta || got > test.want+test.delta {
+			t.Errorf("%s: estimate %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBloomFilterMerge(t *testing.T) {
+	v4 := newBloomFilter()
+	for i := 0; i < 256; i++ {
+		v4.add(net.IPv4(192, 0, 2, byte(i)))
+	}
+	bf := newBloomFilter()
+	bf.merge(v4)
+	bf.merge(bep33Filter())
+	if got := bf.estimate(); got != 1225 {
+		t.Errorf("merged estimate %d, want 1225", got)
+	}
+	// A filter of the wrong size is ignored
+	bf = newBloomFilter()
+	bf.merge([]byte{0xff})
+	if got := bf.estimate(); got != 0 {
+		t.Errorf("estimate %d after merging a short filter", got)
+	}
+}
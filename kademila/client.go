@@ -59,6 +59,19 @@ func (c *connection) close() {
 
 var allConnections = map[string]*connection{}
 
+// client is the state of an interactive session, kept in its context.
+type client struct {
+	// Requests waiting for their response
+	transactions *transactionManager
+}
+
+const clientKey key = 1
+
+func clientFromContext(ctx context.Context) *client {
+	cl, _ := ctx.Value(clientKey).(*client)
+	return cl
+}
+
 var infos = map[string]string{}
 
 type token struct {
@@ -128,8 +141,12 @@ func listConnections(ctx context.Context) error {
 	return nil
 }
 
-func send(ctx context.Context, conn *connection, req *Message, t string) (*Message, error) {
+func send(ctx context.Context, conn *connection, tm *transactionManager, req *Message, t string) (*Message, error) {
 	c, _ := FromContext(ctx)
+	req.N.Addr = conn.addr
+	tm.start(req, nil)
+	defer tm.cancel(req)
+	c.outgoing(req)
 	encoded, err := KRPCEncode(req)
 	if err != nil {
 		return nil, err
@@ -152,7 +169,7 @@ func send(ctx context.Context, conn *connection, req *Message, t string) (*Messa
 		return nil, err
 	}
 	io.WriteString(c.Writer, fmt.Sprintf("%s<-- Packet-received: bytes=%d from=%s %s\n", colorOkGreen, n, addr.String(), colorEndC))
-	res, err := KRPCDecode(&RawData{addr, buffer[:n]})
+	res, err := KRPCDecode(&RawData{addr, buffer[:n]}, tm)
 	if err != nil {
 		return nil, err
 	}
@@ -162,39 +179,41 @@ func send(ctx context.Context, conn *connection, req *Message, t string) (*Messa
 
 func ping(ctx context.Context, conn *connection) error {
 	c, _ := FromContext(ctx)
-	req := KRPCNewPing(c.Local.ID, UndefinedWorker)
-	_, err := send(ctx, conn, req, "5s")
+	req := KRPCNewPing(c.LocalID(), UndefinedWorker)
+	_, err := send(ctx, conn, clientFromContext(ctx).transactions, req, "5s")
 	return err
 }
 
 func findNode(ctx context.Context, conn *connection, target NodeID) error {
 	c, _ := FromContext(ctx)
-	req := KRPCNewFindNode(c.Local.ID, target, UndefinedWorker)
-	res, err := send(ctx, conn, req, "5s")
+	req := KRPCNewFindNode(c.LocalID(), target, UndefinedWorker)
+	res, err := send(ctx, conn, clientFromContext(ctx).transactions, req, "5s")
 	if err != nil {
 		return err
 	}
 	r := res.A.(*FindNodeResponse)
-	io.WriteString(c.Writer, fmt.Sprintf("%d nodes received\n", len(r.Nodes)))
-	for i := range r.Nodes {
-		io.WriteString(c.Writer, fmt.Sprintf("%d %s, Distance=%d, Distance=%d\n", i, r.Nodes[i], Distance(target, r.Nodes[i].ID), Distance(c.Local.ID, r.Nodes[i].ID)))
+	nodes := append(r.Nodes, r.Nodes6...)
+	io.WriteString(c.Writer, fmt.Sprintf("%d nodes received\n", len(nodes)))
+	for i := range nodes {
+		io.WriteString(c.Writer, fmt.Sprintf("%d %s, Distance=%d, Distance=%d\n", i, nodes[i], Distance(target, nodes[i].ID), Distance(c.LocalID(), nodes[i].ID)))
 	}
 	return nil
 }
 
 func getPeers(ctx context.Context, conn *connection, infoHash NodeID) error {
 	c, _ := FromContext(ctx)
-	req := KRPCNewGetPeers(c.Local.ID, infoHash, UndefinedWorker)
-	res, err := send(ctx, conn, req, "5s")
+	req := KRPCNewGetPeers(c.LocalID(), infoHash, UndefinedWorker)
+	res, err := send(ctx, conn, clientFromContext(ctx).transactions, req, "5s")
 	if err != nil {
 		return err
 	}
 	r := res.A.(*GetPeersResponse)
-	io.WriteString(c.Writer, fmt.Sprintf("%d peers received, %d nodes received\n", len(r.Values), len(r.Nodes)))
-	if len(r.Nodes) > 0 {
+	nodes := append(r.Nodes, r.Nodes6...)
+	io.WriteString(c.Writer, fmt.Sprintf("%d peers received, %d nodes received\n", len(r.Values), len(nodes)))
+	if len(nodes) > 0 {
 		io.WriteString(c.Writer, "Node list:\n")
-		for i := range r.Nodes {
-			io.WriteString(c.Writer, fmt.Sprintf("%d %s, Distance=%d, Distance=%d\n", i, r.Nodes[i], Distance(infoHash, r.Nodes[i].ID), Distance(c.Local.ID, r.Nodes[i].ID)))
+		for i := range nodes {
+			io.WriteString(c.Writer, fmt.Sprintf("%d %s, Distance=%d, Distance=%d\n", i, nodes[i], Distance(infoHash, nodes[i].ID), Distance(c.LocalID(), nodes[i].ID)))
 		}
 	}
 	if len(r.Values) > 0 {
@@ -359,7 +378,8 @@ func eval(ctx context.Context, input string) error {
 	return ParseError{"No match pattern"}
 }
 
-func RunClient(ctx context.Context, master chan string, logger *logrus.Logger) {
+// RunClient runs the interactive client with opts, nil for DefaultOptions.
+func RunClient(ctx context.Context, master chan string, logger *logrus.Logger, opts *Options) {
 	var err error
 
 	logger.Formatter = &logrus.TextFormatter{}
@@ -373,12 +393,16 @@ func RunClient(ctx context.Context, master chan string, logger *logrus.Logger) {
 			}).Fatal("Compile regex failed")
 		}
 	}
-	clientCtx := newContext(ctx, master, logger, os.Stdout)
+	clientCtx := newContext(ctx, master, logger, os.Stdout, opts)
 	c, _ := FromContext(clientCtx)
+	cl := &client{transactions: newTransactionManager()}
+	clientCtx = context.WithValue(clientCtx, clientKey, cl)
+	// send waits for its own answers, expired requests are only dropped
+	go cl.transactions.run(clientCtx, func(m *Message) {})
 	io.WriteString(c.Writer, fmt.Sprintf("DHTRobot %s, Type 'help' show help page\n", VERSION))
-	io.WriteString(c.Writer, fmt.Sprintf("Local node ID: %s\n", c.Local.ID.HexString()))
+	io.WriteString(c.Writer, fmt.Sprintf("Local node ID: %s\n", c.LocalID().HexString()))
 
-	infos["NodeID"] = c.Local.ID.HexString()
+	infos["NodeID"] = c.LocalID().HexString()
 
 	for {
 		line, ok := GNUReadLine(">>> ")
@@ -0,0 +1,1024 @@
+package kademila
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/zeebo/bencode"
+)
+
+// krpcPacket is the outer dictionary of every KRPC message.
+type krpcPacket struct {
+	T  string        `bencode:"t"`
+	Y  string        `bencode:"y"`
+	Q  string        `bencode:"q,omitempty"`
+	V  string        `bencode:"v,omitempty"`
+	RO int64         `bencode:"ro,omitempty"`
+	IP string        `bencode:"ip,omitempty"`
+	A  *krpcArgs     `bencode:"a,omitempty"`
+	R  *krpcReturn   `bencode:"r,omitempty"`
+	E  []interface{} `bencode:"e,omitempty"`
+	// Keys without a field
+	Extra map[string]bencode.RawMessage
+}
+
+// krpcArgs is the `a` dictionary of every query.
+type krpcArgs struct {
+	ID          string   `bencode:"id"`
+	Target      string   `bencode:"target,omitempty"`
+	InfoHash    string   `bencode:"info_hash,omitempty"`
+	Port        int      `bencode:"port,omitempty"`
+	ImpliedPort int      `bencode:"implied_port,omitempty"`
+	Token       string   `bencode:"token,omitempty"`
+	Want        []string `bencode:"want,omitempty"`
+	// BEP 33
+	Scrape int `bencode:"scrape,omitempty"`
+	NoSeed int `bencode:"noseed,omitempty"`
+	Seed   int `bencode:"seed,omitempty"`
+	// BEP 44
+	V    bencode.RawMessage `bencode:"v,omitempty"`
+	K    string             `bencode:"k,omitempty"`
+	Sig  string             `bencode:"sig,omitempty"`
+	Seq  *int64             `bencode:"seq,omitempty"`
+	Cas  *int64             `bencode:"cas,omitempty"`
+	Salt string             `bencode:"salt,omitempty"`
+	// Keys without a field
+	Extra map[string]bencode.RawMessage
+}
+
+// krpcReturn is the `r` dictionary of every response.
+type krpcReturn struct {
+	ID     string   `bencode:"id"`
+	Nodes  *string  `bencode:"nodes,omitempty"`
+	Nodes6 string   `bencode:"nodes6,omitempty"`
+	Token  string   `bencode:"token,omitempty"`
+	Values []string `bencode:"values,omitempty"`
+	// BEP 33
+	BFsd string `bencode:"BFsd,omitempty"`
+	BFpe string `bencode:"BFpe,omitempty"`
+	// BEP 44
+	V   bencode.RawMessage `bencode:"v,omitempty"`
+	K   string             `bencode:"k,omitempty"`
+	Sig string             `bencode:"sig,omitempty"`
+	Seq *int64             `bencode:"seq,omitempty"`
+	// BEP 51
+	Interval *int64  `bencode:"interval,omitempty"`
+	Num      *int64  `bencode:"num,omitempty"`
+	Samples  *string `bencode:"samples,omitempty"`
+	// Keys without a field
+	Extra map[string]bencode.RawMessage
+}
+
+// FieldError is a message with a missing or malformed key, Field is the path
+// of the key, e.g. "a.info_hash".
+type FieldError struct {
+	Field string
+	What  string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("Decode error: invalid `%s` field, %s", e.Field, e.What)
+}
+
+// MethodError is a query of a method the node doesn't know.
+type MethodError struct {
+	Method string
+}
+
+func (e *MethodError) Error() string {
+	return fmt.Sprintf("Decode error: unknown method %q", e.Method)
+}
+
+// queryMethods are the queries the node answers.
+var queryMethods = map[string]bool{
+	"ping":              true,
+	"find_node":         true,
+	"get_peers":         true,
+	"announce_peer":     true,
+	"get":               true,
+	"put":               true,
+	"sample_infohashes": true,
+}
+
+// dictField is a tagged field of a struct handled by the codec.
+type dictField struct {
+	key       string
+	index     int
+	omitEmpty bool
+}
+
+// dictType is the codec's view of a tagged struct, the fields are sorted by
+// key as bencode wants them. Keys without a field go to the Extra field if
+// the struct has one.
+type dictType struct {
+	fields []dictField
+	byKey  map[string]int
+	extra  int
+}
+
+// dictTypes caches the dictType of the structs.
+var dictTypes sync.Map
+
+var rawMessageType = reflect.TypeOf(bencode.RawMessage(nil))
+
+func dictTypeOf(t reflect.Type) *dictType {
+	if dt, ok := dictTypes.Load(t); ok {
+		return dt.(*dictType)
+	}
+	dt := &dictType{byKey: make(map[string]int), extra: -1}
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Name == "Extra" {
+			dt.extra = i
+			continue
+		}
+		tag := strings.Split(t.Field(i).Tag.Get("bencode"), ",")
+		if tag[0] != "" && tag[0] != "-" {
+			dt.fields = append(dt.fields, dictField{tag[0], i, len(tag) > 1 && tag[1] == "omitempty"})
+		}
+	}
+	sort.Slice(dt.fields, func(i, j int) bool {
+		return dt.fields[i].key < dt.fields[j].key
+	})
+	for i, f := range dt.fields {
+		dt.byKey[f.key] = i
+	}
+	dictTypes.Store(t, dt)
+	return dt
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// dictDecoder decodes a bencoded message straight into the tagged structs in
+// one pass, the unknown keys are kept as slices of data. A value of the
+// wrong type is skipped and recorded in errs with its path, only invalid
+// bencode stops the decoding.
+type dictDecoder struct {
+	data []byte
+	pos  int
+	errs []*FieldError
+}
+
+func (d *dictDecoder) syntaxError(what string) error {
+	return &DecodeError{fmt.Sprintf("invalid bencode at offset %d, %s", d.pos, what)}
+}
+
+func (d *dictDecoder) peek() (byte, error) {
+	if d.pos >= len(d.data) {
+		return 0, d.syntaxError("unexpected end")
+	}
+	return d.data[d.pos], nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func (d *dictDecoder) readInt() (int64, error) {
+	d.pos++
+	neg := d.pos < len(d.data) && d.data[d.pos] == '-'
+	if neg {
+		d.pos++
+	}
+	begin := d.pos
+	var n int64
+	for d.pos < len(d.data) && isDigit(d.data[d.pos]) && d.pos-begin < 18 {
+		n = n*10 + int64(d.data[d.pos]-'0')
+		d.pos++
+	}
+	if d.pos == begin || d.pos >= len(d.data) || d.data[d.pos] != 'e' {
+		return 0, d.syntaxError("malformed integer")
+	}
+	d.pos++
+	if neg {
+		return -n, nil
+	}
+	return n, nil
+}
+
+// readString returns the string as a slice of data.
+func (d *dictDecoder) readString() ([]byte, error) {
+	begin := d.pos
+	n := 0
+	for d.pos < len(d.data) && isDigit(d.data[d.pos]) && n <= len(d.data) {
+		n = n*10 + int(d.data[d.pos]-'0')
+		d.pos++
+	}
+	if d.pos == begin || d.pos >= len(d.data) || d.data[d.pos] != ':' {
+		return nil, d.syntaxError("malformed string")
+	}
+	d.pos++
+	if n > len(d.data)-d.pos {
+		return nil, d.syntaxError("string exceeds the message")
+	}
+	s := d.data[d.pos : d.pos+n : d.pos+n]
+	d.pos += n
+	return s, nil
+}
+
+// skip moves past the next value.
+func (d *dictDecoder) skip() error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	switch {
+	case c == 'i':
+		_, err = d.readInt()
+		return err
+	case isDigit(c):
+		_, err = d.readString()
+		return err
+	case c == 'l' || c == 'd':
+		dict := c == 'd'
+		d.pos++
+		for {
+			if c, err = d.peek(); err != nil {
+				return err
+			}
+			if c == 'e' {
+				d.pos++
+				return nil
+			}
+			if dict {
+				if _, err = d.readString(); err != nil {
+					return err
+				}
+			}
+			if err = d.skip(); err != nil {
+				return err
+			}
+		}
+	}
+	return d.syntaxError(fmt.Sprintf("unexpected %q", c))
+}
+
+// raw returns the next value undecoded.
+func (d *dictDecoder) raw() (bencode.RawMessage, error) {
+	begin := d.pos
+	if err := d.skip(); err != nil {
+		return nil, err
+	}
+	return d.data[begin:d.pos:d.pos], nil
+}
+
+func kindOf(c byte) string {
+	switch {
+	case c == 'i':
+		return "an integer"
+	case c == 'l':
+		return "a list"
+	case c == 'd':
+		return "a dictionary"
+	}
+	return "a string"
+}
+
+// accepts tells whether a value starting with c decodes into t, and what t
+// would want otherwise.
+func accepts(t reflect.Type, c byte) (bool, string) {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return accepts(t.Elem(), c)
+	case reflect.String:
+		return isDigit(c), "a string"
+	case reflect.Int, reflect.Int64:
+		return c == 'i', "an integer"
+	case reflect.Struct:
+		return c == 'd', "a dictionary"
+	case reflect.Slice:
+		return t == rawMessageType || c == 'l', "a list"
+	}
+	return true, ""
+}
+
+// decodeValue decodes the next value into v, v is key of the dictionary at
+// path, e.g. "a" and "info_hash".
+func (d *dictDecoder) decodeValue(v reflect.Value, path string, key string) error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	if ok, want := accepts(v.Type(), c); !ok {
+		if err = d.skip(); err != nil {
+			return err
+		}
+		d.errs = append(d.errs, &FieldError{joinPath(path, key), fmt.Sprintf("want %s, got %s", want, kindOf(c))})
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		e := reflect.New(v.Type().Elem())
+		v.Set(e)
+		return d.decodeValue(e.Elem(), path, key)
+	case reflect.String:
+		s, err := d.readString()
+		if err != nil {
+			return err
+		}
+		v.SetString(string(s))
+	case reflect.Int, reflect.Int64:
+		n, err := d.readInt()
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Struct:
+		return d.decodeDict(v, joinPath(path, key))
+	case reflect.Slice:
+		if v.Type() == rawMessageType {
+			raw, err := d.raw()
+			if err != nil {
+				return err
+			}
+			v.SetBytes(raw)
+			return nil
+		}
+		d.pos++
+		for {
+			if c, err = d.peek(); err != nil {
+				return err
+			}
+			if c == 'e' {
+				d.pos++
+				return nil
+			}
+			// Decode in place, a malformed element is dropped
+			n, errs := v.Len(), len(d.errs)
+			if n == v.Cap() {
+				grown := reflect.MakeSlice(v.Type(), n, 2*n+4)
+				reflect.Copy(grown, v)
+				v.Set(grown)
+			}
+			v.SetLen(n + 1)
+			if err = d.decodeValue(v.Index(n), path, key); err != nil {
+				return err
+			}
+			if len(d.errs) > errs {
+				v.SetLen(n)
+			}
+		}
+	case reflect.Interface:
+		x, err := d.decodeAny()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(x))
+	}
+	return nil
+}
+
+// decodeAny decodes the next value into an int64, a string, a list or a
+// dictionary of those.
+func (d *dictDecoder) decodeAny() (interface{}, error) {
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c == 'i':
+		return d.readInt()
+	case isDigit(c):
+		s, err := d.readString()
+		return string(s), err
+	case c == 'l':
+		d.pos++
+		l := []interface{}{}
+		for {
+			if c, err = d.peek(); err != nil {
+				return nil, err
+			}
+			if c == 'e' {
+				d.pos++
+				return l, nil
+			}
+			x, err := d.decodeAny()
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, x)
+		}
+	case c == 'd':
+		d.pos++
+		dict := make(map[string]interface{})
+		for {
+			if c, err = d.peek(); err != nil {
+				return nil, err
+			}
+			if c == 'e' {
+				d.pos++
+				return dict, nil
+			}
+			key, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			if dict[string(key)], err = d.decodeAny(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return nil, d.syntaxError(fmt.Sprintf("unexpected %q", c))
+}
+
+// decodeDict decodes the next dictionary into the tagged struct v.
+func (d *dictDecoder) decodeDict(v reflect.Value, path string) error {
+	dt := dictTypeOf(v.Type())
+	var extra map[string]bencode.RawMessage
+	d.pos++
+	for {
+		c, err := d.peek()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			d.pos++
+			break
+		}
+		key, err := d.readString()
+		if err != nil {
+			return err
+		}
+		if i, ok := dt.byKey[string(key)]; ok {
+			f := dt.fields[i]
+			if err = d.decodeValue(v.Field(f.index), path, f.key); err != nil {
+				return err
+			}
+			continue
+		}
+		raw, err := d.raw()
+		if err != nil {
+			return err
+		}
+		if dt.extra >= 0 {
+			if extra == nil {
+				extra = make(map[string]bencode.RawMessage)
+			}
+			extra[string(key)] = raw
+		}
+	}
+	if extra != nil {
+		v.Field(dt.extra).Set(reflect.ValueOf(extra))
+	}
+	return nil
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Int, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	var scratch [20]byte
+	buf.Write(strconv.AppendInt(scratch[:0], int64(len(s)), 10))
+	buf.WriteByte(':')
+	buf.WriteString(s)
+}
+
+func writeInt(buf *bytes.Buffer, n int64) {
+	var scratch [20]byte
+	buf.WriteByte('i')
+	buf.Write(strconv.AppendInt(scratch[:0], n, 10))
+	buf.WriteByte('e')
+}
+
+// encodeValue writes v, tagged structs are written as dictionaries together
+// with their Extra keys.
+func encodeValue(buf *bytes.Buffer, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return &EncodeError{"nil value"}
+		}
+		return encodeValue(buf, v.Elem())
+	case reflect.String:
+		writeString(buf, v.String())
+	case reflect.Int, reflect.Int64:
+		writeInt(buf, v.Int())
+	case reflect.Struct:
+		return encodeDict(buf, v)
+	case reflect.Slice:
+		if v.Type() == rawMessageType {
+			if v.Len() == 0 {
+				return &EncodeError{"empty raw value"}
+			}
+			buf.Write(v.Bytes())
+			return nil
+		}
+		buf.WriteByte('l')
+		for i := 0; i < v.Len(); i++ {
+			if err := encodeValue(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return &EncodeError{"unsupported type " + v.Type().String()}
+	}
+	return nil
+}
+
+// encodeDict writes the tagged struct v merged with its Extra keys in key
+// order, a field which is set wins over an extra key of the same name.
+func encodeDict(buf *bytes.Buffer, v reflect.Value) error {
+	dt := dictTypeOf(v.Type())
+	var extra map[string]bencode.RawMessage
+	var keys []string
+	if dt.extra >= 0 {
+		extra = v.Field(dt.extra).Interface().(map[string]bencode.RawMessage)
+		for key := range extra {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+	}
+	buf.WriteByte('d')
+	i, j := 0, 0
+	for i < len(dt.fields) || j < len(keys) {
+		if j < len(keys) && (i == len(dt.fields) || keys[j] <= dt.fields[i].key) {
+			key := keys[j]
+			j++
+			if i < len(dt.fields) && key == dt.fields[i].key {
+				if !dt.fields[i].omitEmpty || !isEmpty(v.Field(dt.fields[i].index)) {
+					continue
+				}
+				i++
+			}
+			writeString(buf, key)
+			buf.Write(extra[key])
+			continue
+		}
+		f := dt.fields[i]
+		i++
+		fv := v.Field(f.index)
+		if f.omitEmpty && isEmpty(fv) {
+			continue
+		}
+		writeString(buf, f.key)
+		if err := encodeValue(buf, fv); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('e')
+	return nil
+}
+
+func checkLength(path string, val string, want int) error {
+	if len(val) != want {
+		return &FieldError{path, fmt.Sprintf("want %d bytes, got %d", want, len(val))}
+	}
+	return nil
+}
+
+// decodeItem builds the BEP 44 item of a put query or get response.
+func decodeItem(path string, v bencode.RawMessage, k string, sig string, seq *int64, salt string) (*Item, error) {
+	if len(v) == 0 {
+		return nil, &FieldError{path + ".v", "missing"}
+	}
+	item := &Item{V: []byte(v)}
+	if salt != "" {
+		item.Salt = []byte(salt)
+	}
+	if k == "" {
+		return item, nil
+	}
+	if err := checkLength(path+".k", k, 32); err != nil {
+		return nil, err
+	}
+	if err := checkLength(path+".sig", sig, 64); err != nil {
+		return nil, err
+	}
+	if seq == nil {
+		return nil, &FieldError{path + ".seq", "missing"}
+	}
+	item.K = []byte(k)
+	item.Sig = []byte(sig)
+	item.Seq = *seq
+	return item, nil
+}
+
+func decodeArgs(m *Message, a *krpcArgs) error {
+	if err := checkLength("a.id", a.ID, 20); err != nil {
+		return err
+	}
+	switch m.Q {
+	case "ping":
+		m.A = &PingQuery{ID: a.ID}
+	case "find_node":
+		if err := checkLength("a.target", a.Target, 20); err != nil {
+			return err
+		}
+		m.A = &FindNodeQuery{ID: a.ID, Target: a.Target, Want: a.Want}
+	case "get_peers":
+		if err := checkLength("a.info_hash", a.InfoHash, 20); err != nil {
+			return err
+		}
+		m.A = &GetPeersQuery{
+			ID:       a.ID,
+			InfoHash: a.InfoHash,
+			Want:     a.Want,
+			Scrape:   a.Scrape != 0,
+			NoSeed:   a.NoSeed != 0,
+		}
+	case "announce_peer":
+		if err := checkLength("a.info_hash", a.InfoHash, 20); err != nil {
+			return err
+		}
+		if a.Token == "" {
+			return &FieldError{"a.token", "missing"}
+		}
+		q := &AnnouncePeerQuery{
+			ID:          a.ID,
+			ImpliedPort: a.ImpliedPort != 0,
+			InfoHash:    a.InfoHash,
+			Port:        a.Port,
+			Token:       a.Token,
+			Seed:        a.Seed != 0,
+		}
+		if q.ImpliedPort {
+			q.Port = m.N.Port()
+		} else if q.Port <= 0 || q.Port > 65535 {
+			return &FieldError{"a.port", fmt.Sprintf("out of range, got %d", q.Port)}
+		}
+		m.A = q
+	case "get":
+		if err := checkLength("a.target", a.Target, 20); err != nil {
+			return err
+		}
+		m.A = &GetQuery{ID: a.ID, Target: a.Target, Seq: a.Seq, Want: a.Want}
+	case "put":
+		if a.Token == "" {
+			return &FieldError{"a.token", "missing"}
+		}
+		item, err := decodeItem("a", a.V, a.K, a.Sig, a.Seq, a.Salt)
+		if err != nil {
+			return err
+		}
+		m.A = &PutQuery{ID: a.ID, Token: a.Token, Item: item, Cas: a.Cas}
+	case "sample_infohashes":
+		if err := checkLength("a.target", a.Target, 20); err != nil {
+			return err
+		}
+		m.A = &SampleInfoHashesQuery{ID: a.ID, Target: a.Target, Want: a.Want}
+	default:
+		return &MethodError{m.Q}
+	}
+	m.N.ID = []byte(a.ID)
+	return nil
+}
+
+func decodeNodes(r *krpcReturn) ([]Node, []Node) {
+	var nodes []Node
+	if r.Nodes != nil {
+		nodes = ParseNodes(*r.Nodes)
+	}
+	return nodes, ParseNodes6(r.Nodes6)
+}
+
+func decodeBloomFilter(path string, bf string) ([]byte, error) {
+	if bf == "" {
+		return nil, nil
+	}
+	if err := checkLength(path, bf, BloomFilterSize); err != nil {
+		return nil, err
+	}
+	return []byte(bf), nil
+}
+
+func decodeReturn(m *Message, r *krpcReturn) error {
+	if err := checkLength("r.id", r.ID, 20); err != nil {
+		return err
+	}
+	switch m.Q {
+	case "ping":
+		m.A = &PingResponse{ID: r.ID}
+	case "find_node":
+		if r.Nodes == nil && r.Nodes6 == "" {
+			return &FieldError{"r.nodes", "missing"}
+		}
+		payload := &FindNodeResponse{ID: r.ID}
+		payload.Nodes, payload.Nodes6 = decodeNodes(r)
+		m.A = payload
+	case "get_peers":
+		if r.Token == "" {
+			return &FieldError{"r.token", "missing"}
+		}
+		payload := &GetPeersResponse{ID: r.ID, Token: r.Token}
+		var err error
+		if payload.Values, err = ParsePeers(r.Values); err != nil {
+			return &FieldError{"r.values", err.Error()}
+		}
+		payload.Nodes, payload.Nodes6 = decodeNodes(r)
+		if payload.BFsd, err = decodeBloomFilter("r.BFsd", r.BFsd); err != nil {
+			return err
+		}
+		if payload.BFpe, err = decodeBloomFilter("r.BFpe", r.BFpe); err != nil {
+			return err
+		}
+		if len(payload.Values) == 0 && len(payload.Nodes) == 0 && len(payload.Nodes6) == 0 && payload.BFsd == nil && payload.BFpe == nil {
+			return &FieldError{"r.values", "missing, and no nodes either"}
+		}
+		m.A = payload
+	case "announce_peer":
+		m.A = &AnnouncePeerResponse{ID: r.ID}
+	case "get":
+		payload := &GetResponse{ID: r.ID, Token: r.Token}
+		payload.Nodes, payload.Nodes6 = decodeNodes(r)
+		if len(r.V) > 0 {
+			var err error
+			if payload.Item, err = decodeItem("r", r.V, r.K, r.Sig, r.Seq, ""); err != nil {
+				return err
+			}
+		}
+		m.A = payload
+	case "put":
+		m.A = &PutResponse{ID: r.ID}
+	case "sample_infohashes":
+		if r.Samples == nil {
+			return &FieldError{"r.samples", "missing"}
+		}
+		if len(*r.Samples)%20 != 0 {
+			return &FieldError{"r.samples", fmt.Sprintf("length %d is not a multiple of 20", len(*r.Samples))}
+		}
+		payload := &SampleInfoHashesResponse{ID: r.ID}
+		if r.Interval != nil {
+			payload.Interval = int(*r.Interval)
+		}
+		if r.Num != nil {
+			payload.Num = int(*r.Num)
+		}
+		for j := 0; j < len(*r.Samples); j += 20 {
+			payload.Samples = append(payload.Samples, NodeID((*r.Samples)[j:j+20]))
+		}
+		payload.Nodes, payload.Nodes6 = decodeNodes(r)
+		m.A = payload
+	}
+	m.N.ID = []byte(r.ID)
+	return nil
+}
+
+func decodeError(m *Message, e []interface{}) error {
+	if len(e) != 2 {
+		return &FieldError{"e", fmt.Sprintf("want 2 elements, got %d", len(e))}
+	}
+	code, ok := e[0].(int64)
+	if !ok {
+		return &FieldError{"e", fmt.Sprintf("code would be an integer, got %T", e[0])}
+	}
+	desc, ok := e[1].(string)
+	if !ok {
+		return &FieldError{"e", fmt.Sprintf("description would be a string, got %T", e[1])}
+	}
+	m.A = &Err{int(code), desc}
+	return nil
+}
+
+// KRPCDecode decodes raw, responses and errors are matched to their query in
+// tm by transaction ID and source address. Unknown keys are kept in
+// m.Extra and m.ExtraArgs.
+// A query which fails to decode after its `t` was read is returned together
+// with the error, without arguments, so it can still be answered.
+func KRPCDecode(raw *RawData, tm *transactionManager) (*Message, error) {
+	d := &dictDecoder{data: raw.Data}
+	p := new(krpcPacket)
+	c, err := d.peek()
+	if err == nil && c != 'd' {
+		err = d.syntaxError("message would be a dictionary")
+	}
+	if err == nil {
+		err = d.decodeDict(reflect.ValueOf(p).Elem(), "")
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Malformed arguments still leave a query which can be answered, a
+	// malformed `ip` is only a hint less
+	var argsErr, returnErr error
+	for _, e := range d.errs {
+		switch {
+		case e.Field == "ip":
+		case e.Field == "a" || strings.HasPrefix(e.Field, "a."):
+			if argsErr == nil {
+				argsErr = e
+			}
+		case e.Field == "r" || strings.HasPrefix(e.Field, "r."):
+			if returnErr == nil {
+				returnErr = e
+			}
+		default:
+			return nil, e
+		}
+	}
+
+	m := new(Message)
+	m.N.Addr = raw.Addr
+	m.W = UndefinedWorker
+	m.T = p.T
+	m.Y = p.Y
+	m.V = p.V
+	m.RO = p.RO == 1
+	m.Extra = p.Extra
+	if m.T == "" {
+		return nil, &FieldError{"t", "missing"}
+	}
+	if p.IP != "" {
+		m.IP, _ = parseCompactAddr(p.IP)
+	}
+	switch m.Y {
+	case "q":
+		m.Q = p.Q
+		if m.Q == "" {
+			return m, &FieldError{"q", "missing"}
+		}
+		if !queryMethods[m.Q] {
+			return m, &MethodError{m.Q}
+		}
+		if argsErr != nil {
+			return m, argsErr
+		}
+		if p.A == nil {
+			return m, &FieldError{"a", "missing"}
+		}
+		m.ExtraArgs = p.A.Extra
+		if err = decodeArgs(m, p.A); err != nil {
+			return m, err
+		}
+	case "r", "e":
+		tr := tm.get(m.T, raw.Addr)
+		if tr == nil {
+			return nil, &DecodeError{"Unknown request"}
+		}
+		m.Q = tr.q
+		m.W = tr.w
+		if m.Y == "e" {
+			// Errors carry no id, the queried node is known though
+			m.N.ID = tr.node.ID
+			err = decodeError(m, p.E)
+			break
+		}
+		if returnErr != nil {
+			return nil, returnErr
+		}
+		if p.R == nil {
+			return nil, &FieldError{"r", "missing"}
+		}
+		m.ExtraArgs = p.R.Extra
+		err = decodeReturn(m, p.R)
+	case "":
+		return nil, &FieldError{"y", "missing"}
+	default:
+		return nil, &FieldError{"y", "unknown message type " + m.Y}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func newArgs(m *Message) (*krpcArgs, error) {
+	a := new(krpcArgs)
+	switch q := m.A.(type) {
+	case *PingQuery:
+		a.ID = q.ID
+	case *FindNodeQuery:
+		a.ID, a.Target, a.Want = q.ID, q.Target, q.Want
+	case *GetPeersQuery:
+		a.ID, a.InfoHash, a.Want = q.ID, q.InfoHash, q.Want
+		a.Scrape = boolToInt(q.Scrape)
+		a.NoSeed = boolToInt(q.NoSeed)
+	case *AnnouncePeerQuery:
+		a.ID, a.InfoHash, a.Port, a.Token = q.ID, q.InfoHash, q.Port, q.Token
+		a.ImpliedPort = boolToInt(q.ImpliedPort)
+		a.Seed = boolToInt(q.Seed)
+	case *GetQuery:
+		a.ID, a.Target, a.Seq, a.Want = q.ID, q.Target, q.Seq, q.Want
+	case *PutQuery:
+		a.ID, a.Token, a.Cas = q.ID, q.Token, q.Cas
+		a.V = bencode.RawMessage(q.Item.V)
+		a.Salt = string(q.Item.Salt)
+		if q.Item.Mutable() {
+			a.K, a.Sig, a.Seq = string(q.Item.K), string(q.Item.Sig), &q.Item.Seq
+		}
+	case *SampleInfoHashesQuery:
+		a.ID, a.Target, a.Want = q.ID, q.Target, q.Want
+	default:
+		return nil, &EncodeError{fmt.Sprintf("Unknown query %s, %T", m.Q, m.A)}
+	}
+	return a, nil
+}
+
+// setNodes fills `nodes` and `nodes6`, `nodes` is kept even if empty unless
+// there are IPv6 nodes.
+func (r *krpcReturn) setNodes(nodes []Node, nodes6 []Node) {
+	if len(nodes) > 0 || len(nodes6) == 0 {
+		sn := string(ConvertNodeToBytes(nodes))
+		r.Nodes = &sn
+	}
+	r.Nodes6 = string(ConvertNode6ToBytes(nodes6))
+}
+
+func newReturn(m *Message) (*krpcReturn, error) {
+	r := new(krpcReturn)
+	switch a := m.A.(type) {
+	case *PingResponse:
+		r.ID = a.ID
+	case *FindNodeResponse:
+		r.ID = a.ID
+		r.setNodes(a.Nodes, a.Nodes6)
+	case *GetPeersResponse:
+		r.ID, r.Token = a.ID, a.Token
+		r.Values = ConvertPeerToBytes(a.Values)
+		if len(r.Values) == 0 || len(a.Nodes) > 0 || len(a.Nodes6) > 0 {
+			r.setNodes(a.Nodes, a.Nodes6)
+		}
+		r.BFsd, r.BFpe = string(a.BFsd), string(a.BFpe)
+	case *AnnouncePeerResponse:
+		r.ID = a.ID
+	case *GetResponse:
+		r.ID, r.Token = a.ID, a.Token
+		r.setNodes(a.Nodes, a.Nodes6)
+		if a.Item != nil {
+			r.V = bencode.RawMessage(a.Item.V)
+			if a.Item.Mutable() {
+				r.K, r.Sig, r.Seq = string(a.Item.K), string(a.Item.Sig), &a.Item.Seq
+			}
+		}
+	case *PutResponse:
+		r.ID = a.ID
+	case *SampleInfoHashesResponse:
+		r.ID = a.ID
+		interval, num := int64(a.Interval), int64(a.Num)
+		r.Interval, r.Num = &interval, &num
+		buf := bytes.NewBuffer(nil)
+		for _, s := range a.Samples {
+			buf.Write(s)
+		}
+		samples := buf.String()
+		r.Samples = &samples
+		r.setNodes(a.Nodes, a.Nodes6)
+	default:
+		return nil, &EncodeError{fmt.Sprintf("Unknown response %s, %T", m.Q, m.A)}
+	}
+	return r, nil
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// KRPCEncode encodes m, queries with m.RO are marked with `ro` (BEP 43).
+func KRPCEncode(m *Message) (string, error) {
+	p := &krpcPacket{T: m.T, Y: m.Y, V: m.V, Extra: m.Extra}
+	var err error
+	if m.Y != "q" && m.N.Addr != nil {
+		// BEP 42, tell the querying node its address
+		buf := bytes.NewBuffer(nil)
+		convertIPPort(buf, m.N.IP(), m.N.Port())
+		p.IP = buf.String()
+	}
+
+	switch m.Y {
+	case "q":
+		p.Q = m.Q
+		if m.RO {
+			p.RO = 1
+		}
+		if p.A, err = newArgs(m); err != nil {
+			return "", err
+		}
+		p.A.Extra = m.ExtraArgs
+	case "r":
+		if p.R, err = newReturn(m); err != nil {
+			return "", err
+		}
+		p.R.Extra = m.ExtraArgs
+	case "e":
+		e := m.A.(*Err)
+		p.E = []interface{}{e.Code, e.Desc}
+	default:
+		return "", &EncodeError{"Unknown message type " + m.Y}
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, 256))
+	if err = encodeDict(buf, reflect.ValueOf(p).Elem()); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,269 @@
+package kademila
+
+import (
+	"crypto/ed25519"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zeebo/bencode"
+)
+
+var codecAddr = &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 6881}
+
+// encodeDecode encodes m and decodes it again as if it came from codecAddr,
+// responses and errors are matched to a query of worker 3.
+func encodeDecode(t *testing.T, m *Message) (string, *Message) {
+	tm := newTransactionManager()
+	m.N.Addr = codecAddr
+	if m.Y == "q" {
+		tm.start(m, nil)
+	} else {
+		q := &Message{Y: "q", Q: m.Q, W: 3, N: m.N}
+		tm.start(q, nil)
+		m.T = q.T
+	}
+	data, err := KRPCEncode(m)
+	if err != nil {
+		t.Fatalf("%s %s: encode failed, %s", m.Q, m.Y, err)
+	}
+	d, err := KRPCDecode(&RawData{codecAddr, []byte(data)}, tm)
+	if err != nil {
+		t.Fatalf("%s %s: decode failed, %s\n%q", m.Q, m.Y, err, data)
+	}
+	return data, d
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	id := GenerateID()
+	target := GenerateID()
+	nodes := []Node{{ID: GenerateID(), Addr: &net.UDPAddr{IP: net.ParseIP("5.6.7.8").To4(), Port: 6881}}}
+	nodes6 := []Node{{ID: GenerateID(), Addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6881}}}
+	peers := []*Peer{{IP: net.ParseIP("9.9.9.9").To4(), Port: 80}}
+	_, priv, _ := ed25519.GenerateKey(nil)
+	mutable, _ := NewMutableItem(priv, []byte("salt"), 3, "mutable")
+	immutable, _ := NewImmutableItem("immutable")
+	seq := int64(2)
+	scrape := KRPCNewGetPeersResponse("", id, "token", nodes, nil, nil)
+	bf := newBloomFilter()
+	bf.add(net.ParseIP("9.9.9.9"))
+	scrape.A.(*GetPeersResponse).BFsd = []byte(bf)
+	scrape.A.(*GetPeersResponse).BFpe = []byte(newBloomFilter())
+
+	tests := []struct {
+		name string
+		m    *Message
+	}{
+		{"ping", KRPCNewPing(id, 1)},
+		{"ping response", KRPCNewPingResponse("", id)},
+		{"find_node", KRPCNewFindNode(id, target, 1)},
+		{"find_node response", KRPCNewFindNodeResponse("", id, nodes, nodes6)},
+		{"find_node response without nodes", KRPCNewFindNodeResponse("", id, nil, nil)},
+		{"get_peers", KRPCNewGetPeers(id, target, 1)},
+		{"get_peers response with values", KRPCNewGetPeersResponse("", id, "token", nil, nil, peers)},
+		{"get_peers response with nodes", KRPCNewGetPeersResponse("", id, "token", nodes, nodes6, nil)},
+		{"get_peers response with bloom filters", scrape},
+		{"announce_peer", KRPCNewAnnouncePeer(id, target.String(), 80, "token", false, 1)},
+		{"announce_peer implied port", KRPCNewAnnouncePeer(id, target.String(), codecAddr.Port, "token", true, 1)},
+		{"announce_peer response", KRPCNewAnnouncePeerResponse("", id)},
+		{"get", KRPCNewGet(id, target, nil, 1)},
+		{"get with seq", KRPCNewGet(id, target, &seq, 1)},
+		{"get response immutable", KRPCNewGetResponse("", id, "token", nodes, nil, immutable)},
+		{"get response mutable", KRPCNewGetResponse("", id, "token", nodes, nodes6, mutable)},
+		{"get response without item", KRPCNewGetResponse("", id, "token", nodes, nil, nil)},
+		{"put immutable", KRPCNewPut(id, "token", immutable, nil, 1)},
+		{"put mutable", KRPCNewPut(id, "token", mutable, &seq, 1)},
+		{"put response", KRPCNewPutResponse("", id)},
+		{"sample_infohashes", KRPCNewSampleInfoHashes(id, target, 1)},
+		{"sample_infohashes response", KRPCNewSampleInfoHashesResponse("", id, 60, 2, []NodeID{GenerateID(), GenerateID()}, nodes, nil)},
+		{"sample_infohashes response empty", KRPCNewSampleInfoHashesResponse("", id, 60, 0, nil, nodes, nil)},
+		{"ping error", KRPCNewError("", "ping", GenericError)},
+		{"announce_peer error", KRPCNewError("", "announce_peer", ProtocolError)},
+		{"put error", KRPCNewError("", "put", 302)},
+	}
+	for _, test := range tests {
+		data, d := encodeDecode(t, test.m)
+		if d.Y != test.m.Y || d.Q != test.m.Q || d.T != test.m.T {
+			t.Errorf("%s: decoded as %s %s %x", test.name, d.Y, d.Q, d.T)
+		}
+		if d.Y != "q" && d.W != 3 {
+			t.Errorf("%s: matched worker %d, want 3", test.name, d.W)
+		}
+		again, err := KRPCEncode(d)
+		if err != nil || again != data {
+			t.Errorf("%s: encoded again as\n%q, want\n%q", test.name, again, data)
+		}
+		if d.Y == "q" || d.Y == "e" {
+			if !reflect.DeepEqual(d.A, test.m.A) {
+				t.Errorf("%s: decoded %#v, want %#v", test.name, d.A, test.m.A)
+			}
+		}
+	}
+}
+
+func TestCodecExtraKeys(t *testing.T) {
+	m := KRPCNewPing(GenerateID(), 1)
+	m.Extra = map[string]bencode.RawMessage{
+		"a0": bencode.RawMessage("i1e"),
+		"zz": bencode.RawMessage("l1:xe"),
+	}
+	m.ExtraArgs = map[string]bencode.RawMessage{"foo": bencode.RawMessage("d3:bari2ee")}
+	data, d := encodeDecode(t, m)
+	if !reflect.DeepEqual(d.Extra, m.Extra) || !reflect.DeepEqual(d.ExtraArgs, m.ExtraArgs) {
+		t.Errorf("extra keys lost in %q: %v %v", data, d.Extra, d.ExtraArgs)
+	}
+}
+
+func TestCodecReadOnly(t *testing.T) {
+	tests := []struct {
+		name string
+		m    *Message
+		ro   bool
+		want bool
+	}{
+		{"query", KRPCNewPing(GenerateID(), 1), false, false},
+		{"read-only query", KRPCNewPing(GenerateID(), 1), true, true},
+		// Only queries carry `ro`
+		{"response", KRPCNewPingResponse("", GenerateID()), true, false},
+		{"error", KRPCNewError("", "ping", GenericError), true, false},
+	}
+	for _, test := range tests {
+		test.m.RO = test.ro
+		data, d := encodeDecode(t, test.m)
+		if strings.Contains(data, "2:roi1e") != test.want || d.RO != test.want {
+			t.Errorf("%s: ro %v in %q, want %v", test.name, d.RO, data, test.want)
+		}
+	}
+}
+
+func TestCodecErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		field string
+		// A query which is still answered
+		partial bool
+	}{
+		{"not bencode", "x", "", false},
+		{"not a dictionary", "le", "", false},
+		{"truncated", "d1:t2:aa1:y1:q", "", false},
+		{"missing t", "d1:y1:qe", "t", false},
+		{"malformed t", "d1:ti1e1:y1:qe", "t", false},
+		{"missing y", "d1:t2:aae", "y", false},
+		{"missing q", "d1:t2:aa1:y1:qe", "q", true},
+		{"missing a", "d1:q4:ping1:t2:aa1:y1:qe", "a", true},
+		{"a not a dictionary", "d1:ali1ee1:q4:ping1:t2:aa1:y1:qe", "a", true},
+		{"short id", "d1:ad2:id3:abc6:target20:aaaaaaaaaaaaaaaaaaaae1:q9:find_node1:t2:aa1:y1:qe", "a.id", true},
+		{"malformed target", "d1:ad2:id20:aaaaaaaaaaaaaaaaaaaa6:targeti1ee1:q9:find_node1:t2:aa1:y1:qe", "a.target", true},
+		{"missing token", "d1:ad2:id20:aaaaaaaaaaaaaaaaaaaa9:info_hash20:aaaaaaaaaaaaaaaaaaaa4:porti80ee1:q13:announce_peer1:t2:aa1:y1:qe", "a.token", true},
+		{"port out of range", "d1:ad2:id20:aaaaaaaaaaaaaaaaaaaa9:info_hash20:aaaaaaaaaaaaaaaaaaaa4:porti70000e5:token1:xe1:q13:announce_peer1:t2:aa1:y1:qe", "a.port", true},
+	}
+	for _, test := range tests {
+		m, err := KRPCDecode(&RawData{codecAddr, []byte(test.data)}, newTransactionManager())
+		if err == nil {
+			t.Errorf("%s: no error", test.name)
+			continue
+		}
+		if (m != nil) != test.partial {
+			t.Errorf("%s: got message %v, want %v", test.name, m != nil, test.partial)
+		}
+		fe, ok := err.(*FieldError)
+		if test.field == "" {
+			if ok {
+				t.Errorf("%s: got %s, want a bencode error", test.name, err)
+			}
+			continue
+		}
+		if !ok || fe.Field != test.field {
+			t.Errorf("%s: got %s, want an error of %s", test.name, err, test.field)
+		}
+	}
+
+	m, err := KRPCDecode(&RawData{codecAddr, []byte("d1:ad2:id20:aaaaaaaaaaaaaaaaaaaae1:q3:foo1:t2:aa1:y1:qe")}, newTransactionManager())
+	if _, ok := err.(*MethodError); !ok || m == nil {
+		t.Errorf("unknown method: got %v, %s", m, err)
+	}
+	if _, err = KRPCDecode(&RawData{codecAddr, []byte("d1:rd2:id20:aaaaaaaaaaaaaaaaaaaae1:t2:aa1:y1:re")}, newTransactionManager()); err == nil {
+		t.Error("response without query accepted")
+	}
+}
+
+func TestCodecMalformedIP(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   string
+		want string
+	}{
+		{"IPv4", "6:\x05\x06\x07\x08\x1a\xe1", "5.6.7.8:6881"},
+		{"wrong length", "3:abc", ""},
+		{"integer", "i1e", ""},
+		{"list", "l3:abce", ""},
+	}
+	for _, test := range tests {
+		data := "d1:ad2:id20:aaaaaaaaaaaaaaaaaaaae2:ip" + test.ip + "1:q4:ping1:t2:aa1:y1:qe"
+		m, err := KRPCDecode(&RawData{codecAddr, []byte(data)}, newTransactionManager())
+		if err != nil {
+			t.Errorf("%s: message dropped, %s", test.name, err)
+			continue
+		}
+		if test.want == "" && m.IP != nil || test.want != "" && (m.IP == nil || m.IP.String() != test.want) {
+			t.Errorf("%s: got ip %v, want %q", test.name, m.IP, test.want)
+		}
+	}
+}
+
+func benchmarkMessages(b *testing.B) (*transactionManager, [][]byte) {
+	tm := newTransactionManager()
+	id := GenerateID()
+	var nodes []Node
+	for i := 0; i < K; i++ {
+		nodes = append(nodes, Node{ID: GenerateID(), Addr: &net.UDPAddr{IP: net.IPv4(5, 6, 7, byte(i)).To4(), Port: 6881}})
+	}
+	var peers []*Peer
+	for i := 0; i < 50; i++ {
+		peers = append(peers, &Peer{IP: net.IPv4(9, 9, 9, byte(i)).To4(), Port: 80})
+	}
+	msgs := []*Message{
+		KRPCNewPing(id, 1),
+		KRPCNewGetPeers(id, GenerateID(), 1),
+		KRPCNewFindNodeResponse("", id, nodes, nil),
+		KRPCNewGetPeersResponse("", id, "token", nil, nil, peers),
+	}
+	var data [][]byte
+	for _, m := range msgs {
+		m.N.Addr = codecAddr
+		q := &Message{Y: "q", Q: m.Q, N: m.N}
+		tm.start(q, nil)
+		m.T = q.T
+		s, err := KRPCEncode(m)
+		if err != nil {
+			b.Fatal(err)
+		}
+		data = append(data, []byte(s))
+	}
+	return tm, data
+}
+
+// BenchmarkKRPCDecode compares the typed decoder with decoding into a generic
+// map, as KRPCDecode did before.
+func BenchmarkKRPCDecode(b *testing.B) {
+	tm, data := benchmarkMessages(b)
+	b.Run("typed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := KRPCDecode(&RawData{codecAddr, data[i%len(data)]}, tm); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("map", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			val := make(map[string]interface{})
+			if err := bencode.DecodeBytes(data[i%len(data)], &val); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -7,6 +7,9 @@ const VERSION = "0.1.0"
 // Bucket size
 const K int = 8
 
+// Lookup concurrency
+const Alpha int = 3
+
 // Bootstrap nodes
 var BOOTSTRAP = []string{
 	"router.bittorrent.com:6881",
@@ -45,14 +48,71 @@ const MaxUnchangedCount = 5000
 
 const TokenTimeLimit = 300 // seconds
 
+const PeerTimeLimit = 30 // minutes
+
+const PeerExpireInterval = 60 // seconds
+
+const MaxInfoHashes = 10000
+
+const MaxPeersPerInfoHash = 100
+
+const MaxPeerStoreSize = 4 << 20 // bytes
+
+const MaxReturnedPeers = 50
+
+// BEP 51
+const MaxSamples = 20
+
+const SampleInterval = 300 // seconds
+
+// Info hashes CrawlInfoHashes remembers to skip duplicates, between one and
+// two times this
+const CrawlSeenSize = 100000
+
+const ItemTimeLimit = 120 // minutes
+
+const ItemExpireInterval = 60 // seconds
+
+const MaxItems = 10000
+
 const BucketLastChangedTimeLimit = 15 // minutes
 
 const NodeRefreshnessTimeLimit = 60 // seconds
 
+// BEP 5, nodes silent for this long are questionable
+const NodeQuestionableTimeLimit = 15 // minutes
+
+// Unanswered queries in a row after which a node is bad
+const MaxNodeFailures = 3
+
+// Candidates kept for every full bucket
+const ReplacementCacheSize = K
+
 const MaxBitsLength = 160
 
 const FinderNum = 2
 
+// Messages queued for a finder, the responses beyond are dropped
+const FinderQueueSize = 64
+
+// Events buffered for a subscriber which asks for less than one
+const DefaultEventBuffer = 64
+
+// BEP 42 node ID policy of the routing table
+const (
+	SecureIDIgnore  = iota
+	SecureIDPrefer  = iota
+	SecureIDRequire = iota
+)
+
+const SnapshotInterval = 5 // minutes
+
+// BEP 42 external IP discovery, distinct nodes which must agree on our
+// address and the number of recent voters kept
+const ExternalIPVotes = 4
+
+const MaxExternalIPVoters = 50
+
 const UndefinedWorker = -1
 
 var FilteredClients = map[string]bool{
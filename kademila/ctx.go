@@ -2,59 +2,123 @@ package kademila
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"net"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 )
 
 type NodeContext struct {
-	Local     Node
-	Log       *logrus.Logger
-	Conn      net.PacketConn
-	Master    chan string
-	Outgoing  chan *Message
-	Incoming  chan RawData
-	Writer    io.Writer
-	bootstrap []Node
+	// Local.ID may be replaced by SetExternalIP, read it with LocalID
+	Local Node
+	Log   *logrus.Logger
+	Conn  net.PacketConn
+	// IPv6 socket (BEP 32), nil if the host has no IPv6 stack
+	Conn6      net.PacketConn
+	Master     chan string
+	Outgoing   chan *Message
+	Incoming   chan RawData
+	Writer     io.Writer
+	bootstrap  []Node
+	bootstrap6 []Node
+	// Our public addresses, voted by the remote nodes
+	external externalIP
+	// Settings of the node, not to be changed
+	Options *Options
+	// Loaded from Options.IdentityPath, nil if not used
+	identity *identity
+	idLock   sync.RWMutex
 }
 
 type key int
 
 const contextKey key = 0
 
-func newContext(ctx context.Context, master chan string, logger *logrus.Logger, writer io.Writer) context.Context {
+func newContext(ctx context.Context, master chan string, logger *logrus.Logger, writer io.Writer, opts *Options) context.Context {
 	var err error
 
 	c := new(NodeContext)
+	c.Options = copyOptions(opts)
 	c.Master = master
 	c.Log = logger
 	c.Writer = writer
 	c.Outgoing = make(chan *Message)
 	c.Incoming = make(chan RawData)
-	c.Conn, err = net.ListenPacket("udp", "")
+	c.Conn, err = net.ListenPacket("udp4", "")
 	if err != nil {
 		c.Log.Panic(err)
 	}
-	c.Local.ID = GenerateID()
+	c.identity = localIdentity(c)
+	if c.identity != nil {
+		c.Local.ID = NodeID(c.identity.ID)
+	} else {
+		c.Local.ID = GenerateID()
+	}
 	c.Local.Addr = c.Conn.LocalAddr().(*net.UDPAddr)
 	c.Local.Status = GOOD
+
+	// Prefer the same port for both families
+	c.Conn6, err = net.ListenPacket("udp6", fmt.Sprintf(":%d", c.Local.Port()))
+	if err != nil {
+		c.Conn6, err = net.ListenPacket("udp6", "")
+	}
+	if err != nil {
+		c.Log.WithFields(logrus.Fields{
+			"err": err,
+		}).Warn("IPv6 disabled")
+		c.Conn6 = nil
+	}
+
+	c.bootstrap = resolveBootstrap(c, "udp4")
+	if c.Conn6 != nil {
+		c.bootstrap6 = resolveBootstrap(c, "udp6")
+	}
+	return context.WithValue(ctx, contextKey, c)
+}
+
+func resolveBootstrap(c *NodeContext, network string) []Node {
+	var nodes []Node
 	for _, host := range BOOTSTRAP {
-		raddr, err := net.ResolveUDPAddr("udp", host)
+		raddr, err := net.ResolveUDPAddr(network, host)
 		if err != nil {
 			c.Log.WithFields(logrus.Fields{
 				"err": err,
 			}).Error("Resolve DNS error")
 			continue
 		}
-		c.bootstrap = append(c.bootstrap, Node{Addr: raddr})
+		nodes = append(nodes, Node{Addr: raddr})
 		c.Log.WithFields(logrus.Fields{
 			"Host": host,
 			"IP":   raddr.IP,
 			"Port": raddr.Port,
 		}).Info("Bootstrap from")
 	}
-	return context.WithValue(ctx, contextKey, c)
+	return nodes
+}
+
+// LocalID returns our node ID.
+func (c *NodeContext) LocalID() NodeID {
+	c.idLock.RLock()
+	defer c.idLock.RUnlock()
+	return c.Local.ID
+}
+
+func (c *NodeContext) setLocalID(id NodeID) {
+	c.idLock.Lock()
+	defer c.idLock.Unlock()
+	c.Local.ID = id
+}
+
+// outgoing fills the keys of a message we send which come from the options.
+func (c *NodeContext) outgoing(m *Message) {
+	if m.V == "" {
+		m.V = c.Options.ClientVersion
+	}
+	if m.Y == "q" {
+		m.RO = c.Options.ReadOnly
+	}
 }
 
 func FromContext(ctx context.Context) (*NodeContext, bool) {
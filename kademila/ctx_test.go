@@ -0,0 +1,43 @@
+package kademila
+
+import "testing"
+
+func TestOutgoing(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		// Already set on the message
+		v    string
+		want string
+	}{
+		{"default", clientVersion(APPNAME, VERSION), "", "DR\x00\x01"},
+		{"no version", "", "", ""},
+		{"kept", clientVersion(APPNAME, VERSION), "XX\x00\x01", "XX\x00\x01"},
+	}
+	for _, test := range tests {
+		opts := DefaultOptions()
+		opts.ClientVersion = test.version
+		c, _ := FromContext(testContext(t, opts))
+		m := KRPCNewPing(c.LocalID(), UndefinedWorker)
+		m.V = test.v
+		c.outgoing(m)
+		if m.V != test.want {
+			t.Errorf("%s: v %q, want %q", test.name, m.V, test.want)
+		}
+		if data, d := encodeDecode(t, m); d.V != test.want {
+			t.Errorf("%s: decoded v %q from %q, want %q", test.name, d.V, data, test.want)
+		}
+	}
+
+	// Responses are never marked read-only
+	opts := DefaultOptions()
+	opts.ReadOnly = true
+	c, _ := FromContext(testContext(t, opts))
+	q := KRPCNewPing(c.LocalID(), UndefinedWorker)
+	r := KRPCNewPingResponse("aa", c.LocalID())
+	c.outgoing(q)
+	c.outgoing(r)
+	if !q.RO || r.RO {
+		t.Errorf("query ro %v and response ro %v, want true and false", q.RO, r.RO)
+	}
+}
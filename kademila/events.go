@@ -0,0 +1,122 @@
+package kademila
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RoutingEventType tells what changed in a routing table.
+type RoutingEventType int
+
+const (
+	NodeAdded         RoutingEventType = iota
+	NodeStatusChanged RoutingEventType = iota
+	NodeEvicted       RoutingEventType = iota
+	// Node is the one which did not fit, Bucket the one split in two
+	BucketSplit RoutingEventType = iota
+	// Node carries the random target of the refresh lookup
+	BucketRefreshed RoutingEventType = iota
+)
+
+var routingEventNames = []string{
+	"NodeAdded", "NodeStatusChanged", "NodeEvicted", "BucketSplit", "BucketRefreshed",
+}
+
+func (t RoutingEventType) String() string {
+	return routingEventNames[t]
+}
+
+// RoutingEvent is a change of a routing table. Bucket is the index of the
+// bucket at the time of the event, later splits shift the indexes.
+type RoutingEvent struct {
+	Type   RoutingEventType
+	IPv6   bool
+	Node   Node
+	Bucket int
+	Time   time.Time
+}
+
+// Subscription receives routing events on C until Close. Events which do not
+// fit in the buffer of C are dropped rather than stalling the routing table.
+type Subscription struct {
+	C       <-chan RoutingEvent
+	c       chan RoutingEvent
+	hub     *eventHub
+	dropped uint64
+}
+
+// Dropped returns the number of events lost because C was full.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close stops the subscription and closes C.
+func (s *Subscription) Close() {
+	s.hub.lock.Lock()
+	defer s.hub.lock.Unlock()
+	if _, ok := s.hub.subs[s]; ok {
+		delete(s.hub.subs, s)
+		close(s.c)
+	}
+}
+
+type eventHub struct {
+	lock sync.Mutex
+	subs map[*Subscription]bool
+}
+
+func newEventHub() *eventHub {
+	h := new(eventHub)
+	h.subs = make(map[*Subscription]bool)
+	return h
+}
+
+func (h *eventHub) subscribe(buffer int) *Subscription {
+	if buffer < 1 {
+		buffer = DefaultEventBuffer
+	}
+	s := new(Subscription)
+	s.c = make(chan RoutingEvent, buffer)
+	s.C = s.c
+	s.hub = h
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.subs[s] = true
+	return s
+}
+
+// publish hands ev to every subscriber without waiting for any of them.
+func (h *eventHub) publish(ev RoutingEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for s := range h.subs {
+		select {
+		case s.c <- ev:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+// emit publishes an event about node in bucket idx of t, called with t.lock
+// held.
+func (t *table) emit(typ RoutingEventType, node *Node, idx int) {
+	if t.events == nil {
+		return
+	}
+	t.events.publish(RoutingEvent{
+		Type:   typ,
+		IPv6:   t.ipv6,
+		Node:   *node.Clone(),
+		Bucket: idx,
+		Time:   time.Now(),
+	})
+}
+
+// Subscribe returns a subscription to the changes of the routing tables, C
+// buffers up to buffer events, DefaultEventBuffer if buffer is less than one.
+func (k *Kademila) Subscribe(buffer int) *Subscription {
+	return k.events.subscribe(buffer)
+}
@@ -0,0 +1,94 @@
+package kademila
+
+import "testing"
+
+func TestSubscriptionDropped(t *testing.T) {
+	h := newEventHub()
+	small := h.subscribe(2)
+	large := h.subscribe(10)
+	for i := 0; i < 5; i++ {
+		h.publish(RoutingEvent{Type: NodeAdded, Bucket: i})
+	}
+	tests := []struct {
+		name    string
+		s       *Subscription
+		queued  int
+		dropped uint64
+	}{
+		{"small", small, 2, 3},
+		{"large", large, 5, 0},
+	}
+	for _, test := range tests {
+		if len(test.s.C) != test.queued || test.s.Dropped() != test.dropped {
+			t.Errorf("%s: %d queued and %d dropped, want %d and %d", test.name, len(test.s.C), test.s.Dropped(), test.queued, test.dropped)
+		}
+		// The oldest events are kept
+		if ev := <-test.s.C; ev.Bucket != 0 {
+			t.Errorf("%s: first event of bucket %d, want 0", test.name, ev.Bucket)
+		}
+	}
+}
+
+func TestSubscriptionDefaultBuffer(t *testing.T) {
+	h := newEventHub()
+	for _, buffer := range []int{0, -1} {
+		s := h.subscribe(buffer)
+		if cap(s.C) != DefaultEventBuffer {
+			t.Errorf("buffer %d: %d events buffered, want %d", buffer, cap(s.C), DefaultEventBuffer)
+		}
+		h.publish(RoutingEvent{Type: NodeAdded})
+		if len(s.C) != 1 || s.Dropped() != 0 {
+			t.Errorf("buffer %d: event dropped", buffer)
+		}
+		s.Close()
+	}
+}
+
+func TestSubscriptionClose(t *testing.T) {
+	h := newEventHub()
+	s := h.subscribe(1)
+	other := h.subscribe(1)
+	s.Close()
+	s.Close()
+	if _, ok := <-s.C; ok {
+		t.Error("C not closed")
+	}
+	// Publishing after Close neither panics nor counts drops
+	h.publish(RoutingEvent{Type: NodeEvicted})
+	if s.Dropped() != 0 {
+		t.Errorf("%d dropped after Close", s.Dropped())
+	}
+	if len(other.C) != 1 {
+		t.Error("other subscriber lost the event")
+	}
+	if len(h.subs) != 1 {
+		t.Errorf("%d subscribers, want 1", len(h.subs))
+	}
+}
+
+func TestTableEvents(t *testing.T) {
+	ctx := testContext(t, nil)
+	tb := newTable(ctx, false)
+	tb.events = newEventHub()
+	s := tb.events.subscribe(1000)
+	defer s.Close()
+	for i := 1; i <= 3*K; i++ {
+		tb.addNode(testNode(i, true))
+	}
+	added, splits := 0, 0
+	for len(s.C) > 0 {
+		ev := <-s.C
+		switch ev.Type {
+		case NodeAdded:
+			added++
+		case BucketSplit:
+			splits++
+		}
+		if ev.IPv6 {
+			t.Error("IPv4 table event marked IPv6")
+		}
+	}
+	if added != tb.len() || splits != len(tb.buckets)-1 {
+		t.Errorf("%d added and %d splits, want %d and %d", added, splits, tb.len(), len(tb.buckets)-1)
+	}
+}
@@ -0,0 +1,107 @@
+package kademila
+
+import (
+	"net"
+	"sync"
+)
+
+// ipVoter settles on our external address from the `ip` key (BEP 42) of the
+// responses of distinct remote nodes, every remote IP has one vote.
+type ipVoter struct {
+	lock sync.Mutex
+	// Voter IP -> voted address, the last MaxExternalIPVoters voters
+	votes  map[string]string
+	voters []string
+	result net.IP
+}
+
+func newIPVoter() *ipVoter {
+	v := new(ipVoter)
+	v.votes = make(map[string]string)
+	return v
+}
+
+// vote records that voter saw us at ip, it returns the settled address and
+// whether it changed with this vote.
+func (v *ipVoter) vote(voter net.IP, ip net.IP) (net.IP, bool) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	key := voter.String()
+	if _, found := v.votes[key]; !found {
+		v.voters = append(v.voters, key)
+		if len(v.voters) > MaxExternalIPVoters {
+			delete(v.votes, v.voters[0])
+			v.voters = v.voters[1:]
+		}
+	}
+	v.votes[key] = ip.String()
+
+	tally := make(map[string]int)
+	best := ""
+	for _, voted := range v.votes {
+		tally[voted]++
+		if best == "" || tally[voted] > tally[best] {
+			best = voted
+		}
+	}
+	if tally[best] < ExternalIPVotes || tally[best]*2 <= len(v.votes) {
+		return v.result, false
+	}
+	if v.result != nil && v.result.String() == best {
+		return v.result, false
+	}
+	v.result = net.ParseIP(best)
+	return v.result, true
+}
+
+// externalIP is what the remote nodes agreed on as our address.
+type externalIP struct {
+	lock sync.RWMutex
+	ip   net.IP
+	ip6  net.IP
+}
+
+// ExternalIP returns our public IPv4 address as reported by other nodes, nil
+// until enough of them agreed.
+func (c *NodeContext) ExternalIP() net.IP {
+	c.external.lock.RLock()
+	defer c.external.lock.RUnlock()
+	return c.external.ip
+}
+
+// ExternalIP6 is like ExternalIP for IPv6.
+func (c *NodeContext) ExternalIP6() net.IP {
+	c.external.lock.RLock()
+	defer c.external.lock.RUnlock()
+	return c.external.ip6
+}
+
+// NATed reports whether the external IPv4 address is not one of the host's,
+// false while it is unknown.
+func (c *NodeContext) NATed() bool {
+	ip := c.ExternalIP()
+	if ip == nil {
+		return false
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *NodeContext) setExternalIP(ip net.IP) {
+	c.external.lock.Lock()
+	defer c.external.lock.Unlock()
+	if ip.To4() != nil {
+		c.external.ip = ip
+	} else {
+		c.external.ip6 = ip
+	}
+}
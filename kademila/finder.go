@@ -15,14 +15,16 @@ type finder struct {
 	working atomic.Value
 	status  atomic.Value
 	idx     int
+	ipv6    bool
 }
 
-func newFinder(ctx context.Context, idx int) *finder {
+func newFinder(ctx context.Context, idx int, ipv6 bool) *finder {
 	f := new(finder)
 	f.ctx = ctx
-	f.Chan = make(chan *Message)
+	f.Chan = make(chan *Message, FinderQueueSize)
 	f.working.Store(false)
 	f.idx = idx
+	f.ipv6 = ipv6
 	return f
 }
 
@@ -30,18 +32,44 @@ func (f *finder) available() bool {
 	return f.working.Load() == false
 }
 
+// forward hands m to the finder. A response which does not fit in the queue
+// of a slow finder is dropped, the same as a lost packet, but a timeout or
+// an error waits for room until the finder stops, or it would wait for its
+// node forever.
 func (f *finder) forward(m *Message) {
-	if f.working.Load() == true && f.status.Load() != Finished {
-		f.Chan <- m
+	if !f.running() {
+		return
+	}
+	select {
+	case f.Chan <- m:
+		return
+	default:
+	}
+	if m.Y != YTimeout && m.Y != "e" {
+		return
+	}
+	for f.running() {
+		select {
+		case f.Chan <- m:
+			return
+		case <-f.ctx.Done():
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
 	}
 }
 
+func (f *finder) running() bool {
+	return f.working.Load() == true && f.status.Load() != Finished
+}
+
 func (f *finder) findNodes(target NodeID, queriedNodes []Node) map[string]*Node {
 	c, _ := FromContext(f.ctx)
 	allnodes := make(map[string]*Node)
 	f.status.Store(Running)
+	defer f.status.Store(Finished)
 	for i := range queriedNodes {
-		m := KRPCNewFindNode(c.Local.ID, target, f.idx)
+		m := KRPCNewFindNode(c.LocalID(), target, f.idx)
 		m.N = queriedNodes[i]
 		c.Outgoing <- m
 		if len(queriedNodes[i].ID) > 0 {
@@ -52,6 +80,14 @@ func (f *finder) findNodes(target NodeID, queriedNodes []Node) map[string]*Node
 	cond := true
 	begin := time.Now()
 	unchanged := 0
+	pending := func() bool {
+		for _, v := range allnodes {
+			if v.Status == INIT {
+				return true
+			}
+		}
+		return false
+	}
 
 	c.Log.Infof("FindNode(#%d): %s start", f.idx, target.HexString())
 	for cond {
@@ -60,6 +96,12 @@ func (f *finder) findNodes(target NodeID, queriedNodes []Node) map[string]*Node
 		}
 		select {
 		case msg := <-f.Chan:
+			if msg.Y == YTimeout || msg.Y == "e" {
+				if node, ok := allnodes[msg.N.ID.String()]; ok && node.Status == INIT {
+					node.Status = BAD
+				}
+				cond = pending()
+			}
 			if msg.Y != "r" {
 				break
 			}
@@ -70,13 +112,15 @@ func (f *finder) findNodes(target NodeID, queriedNodes []Node) map[string]*Node
 				}).Errorf("FindNode(#%d): Incorrect msg, wants FindNodeResponse, got %s", f.idx, msg.Q)
 				break
 			}
-			c.Log.Debugf("FindNode(#%d): Got %d new nodes, total nodes %d, distance %d, unchanged %d", f.idx, len(response.Nodes), len(allnodes), minDistance, unchanged)
+			nodes := response.nodes(f.ipv6)
+			c.Log.Debugf("FindNode(#%d): Got %d new nodes, total nodes %d, distance %d, unchanged %d", f.idx, len(nodes), len(allnodes), minDistance, unchanged)
 			unchanged++
 			node, ok := allnodes[response.ID]
 			if ok {
 				//c.Log.Infof("%s, v=%s", node, formatVersion(msg.V))
 				if validateClient(msg.V) {
 					node.Status = GOOD
+					node.LastResponse = time.Now()
 				}
 				distance := Distance(target, node.ID)
 				if distance < minDistance {
@@ -92,26 +136,20 @@ func (f *finder) findNodes(target NodeID, queriedNodes []Node) map[string]*Node
 				f.status.Store(Suspend)
 				c.Log.Infof("FindNode(#%d) stopped, exceeds max count %d", f.idx, MaxUnchangedCount)
 			} else {
-				for idx := range response.Nodes {
-					if response.Nodes[idx].Port() <= 0 || net.IP(response.Nodes[idx].IP()).IsUnspecified() {
+				for idx := range nodes {
+					if nodes[idx].Port() <= 0 || net.IP(nodes[idx].IP()).IsUnspecified() {
 						continue
 					}
-					_, ok = allnodes[response.Nodes[idx].ID.String()]
+					_, ok = allnodes[nodes[idx].ID.String()]
 					if !ok {
-						allnodes[response.Nodes[idx].ID.String()] = &response.Nodes[idx]
-						m := KRPCNewFindNode(c.Local.ID, target, f.idx)
-						m.N = response.Nodes[idx]
+						allnodes[nodes[idx].ID.String()] = &nodes[idx]
+						m := KRPCNewFindNode(c.LocalID(), target, f.idx)
+						m.N = nodes[idx]
 						c.Outgoing <- m
 					}
 				}
 			}
-			cond = false
-			for _, v := range allnodes {
-				if v.Status == INIT {
-					cond = true
-					break
-				}
-			}
+			cond = pending()
 
 		case <-time.After(time.Second):
 			now := time.Now()
@@ -129,18 +167,29 @@ func (f *finder) findNodes(target NodeID, queriedNodes []Node) map[string]*Node
 	return allnodes
 }
 
+// pingNodes pings queriedNodes once and marks those answering, even with an
+// error, GOOD and those timing out BAD.
 func (f *finder) pingNodes(queriedNodes []Node) []Node {
 	c, _ := FromContext(f.ctx)
 	var arrayIdx = make(map[string]int)
 	begin := time.Now()
 	f.status.Store(Running)
+	defer f.status.Store(Finished)
 	for i := range queriedNodes {
-		queriedNodes[i].LastSeen = begin
-		m := KRPCNewPing(c.Local.ID, f.idx)
+		queriedNodes[i].Status = QUESTIONABLE
+		m := KRPCNewPing(c.LocalID(), f.idx)
 		m.N = queriedNodes[i]
 		c.Outgoing <- m
 		arrayIdx[queriedNodes[i].ID.String()] = i
 	}
+	pending := func() bool {
+		for i := range queriedNodes {
+			if queriedNodes[i].Status == QUESTIONABLE {
+				return true
+			}
+		}
+		return false
+	}
 
 	cond := true
 	c.Log.Infof("PingNode(#%d) start, stale nodes %d", f.idx, len(queriedNodes))
@@ -150,6 +199,18 @@ func (f *finder) pingNodes(queriedNodes []Node) []Node {
 		}
 		select {
 		case msg := <-f.Chan:
+			if msg.Y == YTimeout || msg.Y == "e" {
+				if idx, ok := arrayIdx[msg.N.ID.String()]; ok && queriedNodes[idx].Status == QUESTIONABLE {
+					// An error still shows the node is alive
+					if msg.Y == "e" {
+						queriedNodes[idx].Status = GOOD
+						queriedNodes[idx].LastResponse = time.Now()
+					} else {
+						queriedNodes[idx].Status = BAD
+					}
+				}
+				cond = pending()
+			}
 			if msg.Y != "r" {
 				break
 			}
@@ -163,31 +224,17 @@ func (f *finder) pingNodes(queriedNodes []Node) []Node {
 			idx, ok := arrayIdx[response.ID]
 			if ok {
 				queriedNodes[idx].Status = GOOD
+				queriedNodes[idx].LastResponse = time.Now()
 			} else {
 				c.Log.Warnf("PingNode(#%d): ID not found %s", f.idx, response.ID)
 			}
+			cond = pending()
 
 		case <-time.After(time.Second):
-			now := time.Now()
-			diff := now.Sub(begin)
-			if f.status.Load() == Running {
-				if diff.Seconds() >= PingNodeTimeLimit {
-					f.status.Store(Suspend)
-					c.Log.Debugf("PingNode(#%d) timeout, exceeds %d seconds", f.idx, PingNodeTimeLimit)
-				} else {
-					resend := 0
-					for i := range queriedNodes {
-						diff2 := now.Sub(queriedNodes[i].LastSeen)
-						if queriedNodes[i].Status != GOOD && diff2.Seconds() >= RequestTimeout {
-							queriedNodes[i].LastSeen = now
-							m := KRPCNewPing(c.Local.ID, f.idx)
-							m.N = queriedNodes[i]
-							c.Outgoing <- m
-							resend++
-						}
-					}
-					c.Log.Debugf("PingNode(#%d) resend %d", f.idx, resend)
-				}
+			diff := time.Now().Sub(begin)
+			if f.status.Load() == Running && diff.Seconds() >= PingNodeTimeLimit {
+				f.status.Store(Suspend)
+				c.Log.Debugf("PingNode(#%d) timeout, exceeds %d seconds", f.idx, PingNodeTimeLimit)
 			}
 
 		case <-f.ctx.Done():
@@ -0,0 +1,87 @@
+package kademila
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/zeebo/bencode"
+)
+
+// identity is what Options.IdentityPath holds, a bencoded dictionary with our
+// node ID and optionally the current token secret, so that tokens handed out
+// before a restart stay valid.
+type identity struct {
+	ID     string `bencode:"id"`
+	Secret *int64 `bencode:"secret,omitempty"`
+}
+
+func loadIdentity(path string) (*identity, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	id := new(identity)
+	if err = bencode.DecodeBytes(data, id); err != nil {
+		return nil, err
+	}
+	if len(id.ID) != 20 {
+		return nil, &DecodeError{"Identity error: invalid node ID"}
+	}
+	return id, nil
+}
+
+func (id *identity) save(path string) error {
+	data, err := bencode.EncodeBytes(id)
+	if err != nil {
+		return err
+	}
+	return writeFile(path, data)
+}
+
+// localIdentity loads the identity from Options.IdentityPath, or creates it
+// with a new node ID when the file does not exist yet. It returns nil if no
+// IdentityPath is set or the file is unusable.
+func localIdentity(c *NodeContext) *identity {
+	path := c.Options.IdentityPath
+	if path == "" {
+		return nil
+	}
+	id, err := loadIdentity(path)
+	if err == nil {
+		c.Log.Infof("Node ID %x loaded from %s", id.ID, path)
+		return id
+	}
+	if !os.IsNotExist(err) {
+		c.Log.WithFields(logrus.Fields{
+			"err":  err,
+			"file": path,
+		}).Error("Load identity failed")
+		return nil
+	}
+	id = &identity{ID: GenerateID().String()}
+	if err = id.save(path); err != nil {
+		c.Log.WithFields(logrus.Fields{
+			"err":  err,
+			"file": path,
+		}).Error("Save identity failed")
+		return nil
+	}
+	c.Log.Infof("Node ID %x saved to %s", id.ID, path)
+	return id
+}
+
+// saveIdentity writes our node ID and token secret to Options.IdentityPath if
+// it is set.
+func (k *Kademila) saveIdentity() error {
+	c, _ := FromContext(k.ctx)
+	if c.identity == nil {
+		return nil
+	}
+	k.saveLock.Lock()
+	defer k.saveLock.Unlock()
+	secret := int64(k.token.secret())
+	c.identity.ID = c.LocalID().String()
+	c.identity.Secret = &secret
+	return c.identity.save(c.Options.IdentityPath)
+}
@@ -0,0 +1,83 @@
+package kademila
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIdentityFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kademila")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := DefaultOptions()
+	opts.IdentityPath = filepath.Join(dir, "identity")
+	ctx := testContext(t, opts)
+	c, _ := FromContext(ctx)
+
+	id := localIdentity(c)
+	if id == nil || len(id.ID) != 20 || id.Secret != nil {
+		t.Fatalf("created %+v", id)
+	}
+	fi, err := os.Stat(opts.IdentityPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("created with mode %v, want 0600", fi.Mode().Perm())
+	}
+	if again := localIdentity(c); again == nil || again.ID != id.ID {
+		t.Errorf("loaded %+v, want %x", again, id.ID)
+	}
+
+	// The node ID and the token secret survive a restart
+	c.identity = id
+	c.setLocalID(NodeID(id.ID))
+	k := &Kademila{ctx: ctx, token: newTokenBuilder()}
+	k.token.setSecret(12345)
+	if err := k.saveIdentity(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadIdentity(opts.IdentityPath)
+	if err != nil || loaded.ID != id.ID || loaded.Secret == nil || *loaded.Secret != 12345 {
+		t.Errorf("saved %+v, %v", loaded, err)
+	}
+	if fi, _ := os.Stat(opts.IdentityPath); fi.Mode().Perm() != 0600 {
+		t.Errorf("saved with mode %v, want 0600", fi.Mode().Perm())
+	}
+}
+
+func TestIdentityUnusable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kademila")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"not bencode", "x"},
+		{"short ID", "d2:id3:abce"},
+	}
+	for _, test := range tests {
+		opts := DefaultOptions()
+		opts.IdentityPath = filepath.Join(dir, test.name)
+		ioutil.WriteFile(opts.IdentityPath, []byte(test.data), 0600)
+		c, _ := FromContext(testContext(t, opts))
+		if id := localIdentity(c); id != nil {
+			t.Errorf("%s: loaded %+v", test.name, id)
+		}
+		// The file is left alone
+		if data, _ := ioutil.ReadFile(opts.IdentityPath); string(data) != test.data {
+			t.Errorf("%s: overwritten with %q", test.name, data)
+		}
+	}
+	c, _ := FromContext(testContext(t, nil))
+	if id := localIdentity(c); id != nil {
+		t.Errorf("loaded %+v without a path", id)
+	}
+}
@@ -0,0 +1,119 @@
+package kademila
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"fmt"
+	"strconv"
+
+	"github.com/zeebo/bencode"
+)
+
+// BEP 44 limits
+const (
+	MaxItemSize = 1000 // bytes, bencoded value
+	MaxSaltSize = 64   // bytes
+)
+
+// Item is a BEP 44 data item. V is the bencoded value; mutable items also
+// carry the ed25519 public key K, the signature Sig, the sequence number Seq
+// and an optional Salt.
+type Item struct {
+	V    []byte
+	K    []byte
+	Sig  []byte
+	Seq  int64
+	Salt []byte
+}
+
+// NewImmutableItem bencodes v into an immutable item, its target is the
+// SHA-1 of the bencoded value.
+func NewImmutableItem(v interface{}) (*Item, error) {
+	encoded, err := bencode.EncodeBytes(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(encoded) > MaxItemSize {
+		return nil, ArgumentError{fmt.Sprintf("value would be at most %d bytes, got %d", MaxItemSize, len(encoded))}
+	}
+	return &Item{V: encoded}, nil
+}
+
+// NewMutableItem bencodes v into a mutable item signed by key, its target is
+// the SHA-1 of the public key and salt.
+func NewMutableItem(key ed25519.PrivateKey, salt []byte, seq int64, v interface{}) (*Item, error) {
+	item, err := NewImmutableItem(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(salt) > MaxSaltSize {
+		return nil, ArgumentError{fmt.Sprintf("salt would be at most %d bytes, got %d", MaxSaltSize, len(salt))}
+	}
+	item.K = key.Public().(ed25519.PublicKey)
+	item.Salt = salt
+	item.Seq = seq
+	item.Sig = ed25519.Sign(key, item.signBuffer())
+	return item, nil
+}
+
+func (item *Item) Mutable() bool {
+	return len(item.K) > 0
+}
+
+func (item *Item) Target() NodeID {
+	if item.Mutable() {
+		return MutableTarget(item.K, item.Salt)
+	}
+	sum := sha1.Sum(item.V)
+	return sum[:]
+}
+
+// MutableTarget returns the target of the mutable items of key and salt.
+func MutableTarget(key []byte, salt []byte) NodeID {
+	hash := sha1.New()
+	hash.Write(key)
+	hash.Write(salt)
+	return hash.Sum(nil)
+}
+
+// signBuffer returns the signed content: salt, seq and v as bencoded
+// key-value pairs without the enclosing dictionary.
+func (item *Item) signBuffer() []byte {
+	buf := bytes.NewBuffer(nil)
+	if len(item.Salt) > 0 {
+		buf.WriteString("4:salt")
+		buf.WriteString(strconv.Itoa(len(item.Salt)))
+		buf.WriteString(":")
+		buf.Write(item.Salt)
+	}
+	buf.WriteString("3:seqi")
+	buf.WriteString(strconv.FormatInt(item.Seq, 10))
+	buf.WriteString("e1:v")
+	buf.Write(item.V)
+	return buf.Bytes()
+}
+
+// Verify checks the signature of a mutable item, immutable items are always
+// valid.
+func (item *Item) Verify() bool {
+	if !item.Mutable() {
+		return true
+	}
+	if len(item.K) != ed25519.PublicKeySize || len(item.Sig) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(item.K), item.signBuffer(), item.Sig)
+}
+
+// Value decodes the bencoded value into v.
+func (item *Item) Value(v interface{}) error {
+	return bencode.DecodeBytes(item.V, v)
+}
+
+func (item *Item) String() string {
+	if item.Mutable() {
+		return fmt.Sprintf("V=%q, K=%x, Seq=%d, Salt=%x, Sig=%x", item.V, item.K, item.Seq, item.Salt, item.Sig)
+	}
+	return fmt.Sprintf("V=%q", item.V)
+}
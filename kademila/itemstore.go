@@ -0,0 +1,107 @@
+package kademila
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+type storedItem struct {
+	item   *Item
+	stored time.Time
+}
+
+// itemStore keeps the BEP 44 items put to us, keyed by target. Items expire
+// after ItemTimeLimit unless they are put again.
+type itemStore struct {
+	lock       *sync.Mutex
+	items      map[string]*storedItem
+	lastExpire time.Time
+}
+
+func newItemStore() *itemStore {
+	s := new(itemStore)
+	s.lock = new(sync.Mutex)
+	s.items = make(map[string]*storedItem)
+	s.lastExpire = time.Now()
+	return s
+}
+
+// put validates and stores item, it returns 0 or the KRPC error code to
+// reply with. cas is the sequence number the writer expects us to have.
+func (s *itemStore) put(item *Item, cas *int64) int {
+	if len(item.V) > MaxItemSize {
+		return MessageTooBig
+	}
+	if len(item.Salt) > MaxSaltSize {
+		return SaltTooBig
+	}
+	if !item.Verify() {
+		return InvalidSignature
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := item.Target().String()
+	old, ok := s.items[key]
+	if ok && item.Mutable() {
+		if cas != nil && *cas != old.item.Seq {
+			return CasMismatch
+		}
+		// Putting the stored value again only refreshes it
+		if item.Seq < old.item.Seq || item.Seq == old.item.Seq && !bytes.Equal(item.V, old.item.V) {
+			return SequenceTooSmall
+		}
+	}
+	if !ok && len(s.items) >= MaxItems {
+		s.removeOldest()
+	}
+	s.items[key] = &storedItem{item, time.Now()}
+	return 0
+}
+
+func (s *itemStore) get(target string) *Item {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	si, ok := s.items[target]
+	if !ok {
+		return nil
+	}
+	return si.item
+}
+
+func (s *itemStore) removeOldest() {
+	var key string
+	var t time.Time
+	for k, si := range s.items {
+		if key == "" || si.stored.Before(t) {
+			key = k
+			t = si.stored
+		}
+	}
+	delete(s.items, key)
+}
+
+func (s *itemStore) expire() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastExpire).Seconds() < ItemExpireInterval {
+		return
+	}
+	s.lastExpire = now
+	for k, si := range s.items {
+		if now.Sub(si.stored).Minutes() >= ItemTimeLimit {
+			delete(s.items, k)
+		}
+	}
+}
+
+func (s *itemStore) len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.items)
+}
@@ -0,0 +1,108 @@
+package kademila
+
+import (
+	"crypto/ed25519"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestItemStorePut(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	item := func(seq int64, v string) *Item {
+		it, _ := NewMutableItem(key, []byte("salt"), seq, v)
+		return it
+	}
+	immutable, _ := NewImmutableItem("immutable")
+	huge := &Item{V: []byte(strings.Repeat("x", MaxItemSize+1))}
+	salty := item(1, "v")
+	salty.Salt = []byte(strings.Repeat("s", MaxSaltSize+1))
+	forged := item(1, "v")
+	forged.V = []byte("1:w")
+	cas := func(n int64) *int64 { return &n }
+
+	s := newItemStore()
+	tests := []struct {
+		name string
+		item *Item
+		cas  *int64
+		want int
+	}{
+		{"immutable", immutable, nil, 0},
+		{"immutable again", immutable, nil, 0},
+		{"too big", huge, nil, MessageTooBig},
+		{"salt too big", salty, nil, SaltTooBig},
+		{"bad signature", forged, nil, InvalidSignature},
+		{"mutable", item(2, "two"), nil, 0},
+		{"same sequence", item(2, "two"), nil, 0},
+		{"same sequence, other value", item(2, "deux"), nil, SequenceTooSmall},
+		{"older sequence", item(1, "one"), nil, SequenceTooSmall},
+		{"cas mismatch", item(3, "three"), cas(1), CasMismatch},
+		{"cas", item(3, "three"), cas(2), 0},
+	}
+	for _, test := range tests {
+		if got := s.put(test.item, test.cas); got != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, got, test.want)
+		}
+	}
+	if got := s.get(item(0, "").Target().String()); got == nil || got.Seq != 3 || string(got.V) != "5:three" {
+		t.Errorf("stored %v, want sequence 3", got)
+	}
+	// The same value again refreshes it
+	key3 := item(3, "three").Target().String()
+	s.items[key3].stored = time.Now().Add(-time.Hour)
+	if got := s.put(item(3, "three"), nil); got != 0 || time.Since(s.items[key3].stored) > time.Minute {
+		t.Errorf("put of the stored value got %d, stored at %v", got, s.items[key3].stored)
+	}
+	if got := s.get(immutable.Target().String()); got != immutable {
+		t.Errorf("stored %v, want %v", got, immutable)
+	}
+	if s.len() != 2 {
+		t.Errorf("%d items, want 2", s.len())
+	}
+}
+
+func TestItemStoreLimits(t *testing.T) {
+	s := newItemStore()
+	first, _ := NewImmutableItem(0)
+	s.put(first, nil)
+	s.items[first.Target().String()].stored = time.Now().Add(-time.Minute)
+	for i := 1; i <= MaxItems; i++ {
+		it, _ := NewImmutableItem(i)
+		s.put(it, nil)
+	}
+	if s.len() != MaxItems {
+		t.Errorf("%d items, want %d", s.len(), MaxItems)
+	}
+	if s.get(first.Target().String()) != nil {
+		t.Error("oldest item kept")
+	}
+}
+
+func TestItemStoreExpire(t *testing.T) {
+	s := newItemStore()
+	old, _ := NewImmutableItem("old")
+	fresh, _ := NewImmutableItem("fresh")
+	s.put(old, nil)
+	s.put(fresh, nil)
+	s.items[old.Target().String()].stored = time.Now().Add(-ItemTimeLimit * time.Minute)
+
+	s.expire()
+	if s.len() != 2 {
+		t.Fatal("expired before ItemExpireInterval")
+	}
+	s.lastExpire = time.Now().Add(-ItemExpireInterval * time.Second)
+	s.expire()
+	if s.get(old.Target().String()) != nil || s.get(fresh.Target().String()) == nil {
+		t.Error("expired the wrong items")
+	}
+
+	// Putting an item again keeps it
+	s.items[fresh.Target().String()].stored = time.Now().Add(-ItemTimeLimit * time.Minute)
+	s.put(fresh, nil)
+	s.lastExpire = time.Now().Add(-ItemExpireInterval * time.Second)
+	s.expire()
+	if s.get(fresh.Target().String()) == nil {
+		t.Error("item put again expired")
+	}
+}
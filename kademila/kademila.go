@@ -2,52 +2,137 @@ package kademila
 
 import (
 	"context"
+	"crypto/ed25519"
+	"fmt"
 	"net"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 type Kademila struct {
-	Chan    chan string
-	ctx     context.Context
-	routing *table
-	token   *TokenBuilder
+	Chan     chan string
+	ctx      context.Context
+	routing  *table
+	routing6 *table
+	token    *TokenBuilder
+	peers    *peerStore
+	items    *itemStore
+	// Outstanding queries
+	transactions *transactionManager
+	// KRPC errors sent, by code
+	errors *errorCounter
+	// External address votes (BEP 42)
+	voter  *ipVoter
+	voter6 *ipVoter
+	// OnExternalIP callbacks and the addresses they were last told
+	handlerLock      sync.Mutex
+	externalHandlers []func(ip net.IP)
+	externalLock     sync.Mutex
+	notified         map[bool]net.IP
+	// Serializes the writes of the identity and snapshot files, Close runs
+	// on the caller's goroutine
+	saveLock sync.Mutex
+	// Last time the snapshot was written to Options.SnapshotPath
+	lastSnapshot time.Time
+	// Subscribers of the routing table changes
+	events *eventHub
+	// Serializes the node ID changes and the rebuilds which follow them
+	idLock      sync.Mutex
+	rebuildLock sync.Mutex
 }
 
-func Restore(master chan string, id NodeID, routing []byte) *Kademila {
-	k := new(Kademila)
-	// k.Local.ID = id
-	// k.master = master
-	return k
+// Restore starts a node from a snapshot made by Snapshot, with the saved node
+// ID unless Options.IdentityPath provides one. The saved nodes are pinged and
+// only those answering join the routing tables. A nil opts means
+// DefaultOptions.
+func Restore(ctx context.Context, master chan string, logger *logrus.Logger, opts *Options, data []byte) (*Kademila, error) {
+	s, err := decodeSnapshot(data)
+	if err != nil {
+		return nil, err
+	}
+	k := newKademila(ctx, master, logger, opts)
+	c, _ := FromContext(k.ctx)
+	if c.identity == nil {
+		// The tables are still empty, only their buckets follow the ID
+		c.setLocalID(NodeID(s.ID))
+		for _, t := range k.tables() {
+			t.rebuild()
+		}
+	}
+	k.start(false)
+
+	go k.routing.restore(snapshotNodes(s.Buckets))
+	if k.routing6 != nil {
+		go k.routing6.restore(snapshotNodes(s.Buckets6))
+	}
+	return k, nil
+}
+
+// New starts a node with opts, nil for DefaultOptions.
+func New(ctx context.Context, master chan string, logger *logrus.Logger, opts *Options) (*Kademila, error) {
+	k := newKademila(ctx, master, logger, opts)
+	k.start(true)
+	return k, nil
 }
 
-func New(ctx context.Context, master chan string, logger *logrus.Logger) (*Kademila, error) {
+func newKademila(ctx context.Context, master chan string, logger *logrus.Logger, opts *Options) *Kademila {
 	k := new(Kademila)
-	k.ctx = newContext(ctx, master, logger, os.Stdout)
+	k.ctx = newContext(ctx, master, logger, os.Stdout, opts)
 	k.Chan = make(chan string)
-	k.routing = newTable(k.ctx)
+	k.routing = newTable(k.ctx, false)
 	k.token = newTokenBuilder()
+	k.peers = newPeerStore()
+	k.items = newItemStore()
+	k.transactions = newTransactionManager()
+	k.errors = newErrorCounter()
+	k.voter = newIPVoter()
+	k.voter6 = newIPVoter()
+	k.notified = make(map[bool]net.IP)
+	k.lastSnapshot = time.Now()
+	k.events = newEventHub()
+	k.routing.events = k.events
 
 	c, _ := FromContext(k.ctx)
-	c.Log.WithFields(logrus.Fields{
-		"ID":   c.Local.ID.HexString(),
+	if c.identity != nil && c.identity.Secret != nil {
+		k.token.setSecret(uint32(*c.identity.Secret))
+	}
+	if c.Conn6 != nil {
+		k.routing6 = newTable(k.ctx, true)
+		k.routing6.events = k.events
+	}
+	return k
+}
+
+func (k *Kademila) start(bootstrap bool) {
+	c, _ := FromContext(k.ctx)
+	fields := logrus.Fields{
+		"ID":   c.LocalID().HexString(),
 		"Addr": c.Local.Addr.String(),
-	}).Info("Node started success")
+	}
+	if c.Conn6 != nil {
+		fields["Addr6"] = c.Conn6.LocalAddr().String()
+	}
+	c.Log.WithFields(fields).Info("Node started success")
 
-	go func() { k.mainLoop(true) }()
-	go func() { k.incomingLoop() }()
+	go func() { k.mainLoop(bootstrap) }()
+	go func() { k.incomingLoop(c.Conn) }()
+	if c.Conn6 != nil {
+		go func() { k.incomingLoop(c.Conn6) }()
+	}
 	go func() { k.outgoingLoop() }()
-
-	return k, nil
+	go func() { k.transactions.run(k.ctx, k.timeout) }()
 }
 
 func (k *Kademila) mainLoop(bootstrap bool) {
 	c, _ := FromContext(k.ctx)
 
 	if bootstrap {
-		k.routing.bootstrap(c.Local.ID)
+		for _, t := range k.tables() {
+			t.bootstrap(c.LocalID())
+		}
 	}
 	for {
 		select {
@@ -57,13 +142,19 @@ func (k *Kademila) mainLoop(bootstrap bool) {
 			}).Debug("Receive from master")
 
 		case raw := <-c.Incoming:
-			msg, err := KRPCDecode(&raw)
+			msg, err := KRPCDecode(&raw, k.transactions)
 			if err != nil {
 				c.Log.WithFields(logrus.Fields{
 					"err": err,
 				}).Error("Decode failed")
+				if msg != nil {
+					k.replyError(msg, err)
+				}
 				break
 			}
+			if msg.Y != "q" {
+				k.transactions.finish(msg)
+			}
 			k.processMessage(msg)
 
 		case <-time.After(time.Second):
@@ -72,9 +163,91 @@ func (k *Kademila) mainLoop(bootstrap bool) {
 	}
 }
 
+// tables returns the routing tables, IPv4 first.
+func (k *Kademila) tables() []*table {
+	if k.routing6 != nil {
+		return []*table{k.routing, k.routing6}
+	}
+	return []*table{k.routing}
+}
+
+// tableFor returns the routing table of node's address family, nil for an
+// IPv6 node when we have no IPv6 table.
+func (k *Kademila) tableFor(node *Node) *table {
+	if node.IsIPv6() {
+		return k.routing6
+	}
+	return k.routing
+}
+
+// addNode adds node to the routing table of its address family, if any.
+func (k *Kademila) addNode(node *Node) {
+	if t := k.tableFor(node); t != nil {
+		t.addNode(node)
+	}
+}
+
+// forward hands m to the finders of the routing table of its sender's
+// address family, if any.
+func (k *Kademila) forward(m *Message) {
+	if t := k.tableFor(&m.N); t != nil {
+		t.forward(m)
+	}
+}
+
+// closestNodes answers the BEP 32 `want` of a query, without `want` only the
+// nodes of the querying node's address family are returned.
+func (k *Kademila) closestNodes(target string, want []string, from *Node) ([]Node, []Node) {
+	var nodes, nodes6 []Node
+	n4, n6 := false, false
+	for _, w := range want {
+		switch w {
+		case "n4":
+			n4 = true
+		case "n6":
+			n6 = true
+		}
+	}
+	if !n4 && !n6 {
+		n4 = !from.IsIPv6()
+		n6 = from.IsIPv6()
+	}
+	if n4 {
+		nodes = k.routing.findNode(target)
+	}
+	if n6 && k.routing6 != nil {
+		nodes6 = k.routing6.findNode(target)
+	}
+	return nodes, nodes6
+}
+
 func (k *Kademila) transition() {
-	k.routing.check()
+	for _, t := range k.tables() {
+		t.check()
+	}
 	k.token.renewToken()
+	k.peers.expire()
+	k.items.expire()
+	c, _ := FromContext(k.ctx)
+	k.saveLock.Lock()
+	due := time.Now().Sub(k.lastSnapshot).Minutes() >= SnapshotInterval
+	k.saveLock.Unlock()
+	if c.Options.SnapshotPath != "" && due {
+		if err := k.saveSnapshot(); err != nil {
+			c.Log.WithFields(logrus.Fields{
+				"err": err,
+			}).Error("Save snapshot failed")
+		}
+	}
+}
+
+// timeout marks the node of an unanswered query as failed and tells the
+// finder which sent it.
+func (k *Kademila) timeout(m *Message) {
+	if t := k.tableFor(&m.N); t != nil {
+		t.failNode(&m.N)
+		t.forward(m)
+	}
 }
 
 func (k *Kademila) processQuery(m *Message) error {
@@ -85,19 +258,32 @@ func (k *Kademila) processQuery(m *Message) error {
 		"m": m.String(),
 	}).Info("Request received:")
 
+	m.N.LastQuery = time.Now()
+	if c.Options.ReadOnly {
+		// BEP 43, read-only nodes don't answer queries
+		if validateClient(m.V) && !m.RO {
+			k.addNode(&m.N)
+		}
+		return nil
+	}
+
 	switch m.Q {
 	case "ping":
-		out = KRPCNewPingResponse(m.T, c.Local.ID)
+		out = KRPCNewPingResponse(m.T, c.LocalID())
 	case "find_node":
 		q := m.A.(*FindNodeQuery)
-		nodes := k.routing.findNode(q.Target)
-		out = KRPCNewFindNodeResponse(m.T, c.Local.ID, nodes)
+		nodes, nodes6 := k.closestNodes(q.Target, q.Want, &m.N)
+		out = KRPCNewFindNodeResponse(m.T, c.LocalID(), nodes, nodes6)
 	case "get_peers":
 		q := m.A.(*GetPeersQuery)
-		nodes := k.routing.findNode(q.InfoHash)
-		out = KRPCNewGetPeersResponse(m.T, c.Local.ID, k.token.create(m.N.Addr.String()), nodes, []*Peer{})
+		nodes, nodes6 := k.closestNodes(q.InfoHash, q.Want, &m.N)
+		values := k.peers.get(q.InfoHash, MaxReturnedPeers, m.N.IsIPv6(), q.NoSeed)
+		out = KRPCNewGetPeersResponse(m.T, c.LocalID(), k.token.create(m.N.Addr.String()), nodes, nodes6, values)
+		if q.Scrape {
+			r := out.A.(*GetPeersResponse)
+			r.BFsd, r.BFpe = k.peers.scrape(q.InfoHash)
+		}
 	case "announce_peer":
-		//TODO save peer
 		q := m.A.(*AnnouncePeerQuery)
 		if !k.token.validate(q.Token, m.N.Addr.String()) {
 			out = KRPCNewError(m.T, "announce_peer", ProtocolError)
@@ -106,12 +292,38 @@ func (k *Kademila) processQuery(m *Message) error {
 				"ip": m.N.Addr.String(),
 			}).Warnf("Invalid token:")
 		} else {
-			out = KRPCNewAnnouncePeerResponse(m.T, c.Local.ID)
+			k.peers.add(q.InfoHash, &Peer{Port: q.Port, IP: m.N.IP()}, q.Seed)
+			out = KRPCNewAnnouncePeerResponse(m.T, c.LocalID())
+		}
+	case "get":
+		q := m.A.(*GetQuery)
+		nodes, nodes6 := k.closestNodes(q.Target, q.Want, &m.N)
+		item := k.items.get(q.Target)
+		if item != nil && item.Mutable() && q.Seq != nil && item.Seq <= *q.Seq {
+			item = nil
+		}
+		out = KRPCNewGetResponse(m.T, c.LocalID(), k.token.create(m.N.Addr.String()), nodes, nodes6, item)
+	case "put":
+		q := m.A.(*PutQuery)
+		if !k.token.validate(q.Token, m.N.Addr.String()) {
+			out = KRPCNewError(m.T, "put", ProtocolError)
+			c.Log.WithFields(logrus.Fields{
+				"t":  q.Token,
+				"ip": m.N.Addr.String(),
+			}).Warnf("Invalid token:")
+		} else if code := k.items.put(q.Item, q.Cas); code != 0 {
+			out = KRPCNewError(m.T, "put", code)
+		} else {
+			out = KRPCNewPutResponse(m.T, c.LocalID())
 		}
+	case "sample_infohashes":
+		q := m.A.(*SampleInfoHashesQuery)
+		nodes, nodes6 := k.closestNodes(q.Target, q.Want, &m.N)
+		out = KRPCNewSampleInfoHashesResponse(m.T, c.LocalID(), SampleInterval, k.peers.len(), k.peers.sample(MaxSamples), nodes, nodes6)
 	}
 
-	if validateClient(m.V) {
-		k.routing.addNode(&m.N)
+	if validateClient(m.V) && !m.RO {
+		k.addNode(&m.N)
 	}
 	out.N = m.N
 	c.Outgoing <- out
@@ -126,26 +338,122 @@ func (k *Kademila) processResponse(m *Message) error {
 	}).Debug("Response received:")
 
 	switch m.Q {
-	case "ping", "find_node":
-		k.routing.forward(m)
-	case "get_peers":
-	case "announce_peer":
+	case "ping", "find_node", "get_peers", "announce_peer", "get", "put", "sample_infohashes":
+		k.forward(m)
+	}
+	if m.IP != nil {
+		k.voteExternalIP(m)
 	}
 
-	if validateClient(m.V) {
-		k.routing.addNode(&m.N)
+	m.N.LastResponse = time.Now()
+	if validateClient(m.V) && !m.RO {
+		k.addNode(&m.N)
 	}
 	return nil
 }
 
+// voteExternalIP counts the address the sender of m saw us at. Once the vote
+// settles on a new address it is set on NodeContext and the change is
+// applied in the background.
+func (k *Kademila) voteExternalIP(m *Message) {
+	c, _ := FromContext(k.ctx)
+	ip := m.IP.IP
+	ipv6 := ip.To4() == nil
+	// A node can only tell our address in its own family
+	if ip.IsUnspecified() || ipv6 != m.N.IsIPv6() {
+		return
+	}
+	voter := k.voter
+	if ipv6 {
+		voter = k.voter6
+	}
+	ip, changed := voter.vote(m.N.IP(), ip)
+	if !changed {
+		return
+	}
+	c.setExternalIP(ip)
+	c.Log.WithFields(logrus.Fields{
+		"ip":  ip.String(),
+		"nat": c.NATed(),
+	}).Info("External IP changed")
+	go k.externalIPChanged(ipv6)
+}
+
+// OnExternalIP registers fn to be called with our new address every time the
+// remote nodes agree on another external IPv4 or IPv6 address. The calls are
+// made one at a time from a background goroutine.
+func (k *Kademila) OnExternalIP(fn func(ip net.IP)) {
+	k.handlerLock.Lock()
+	defer k.handlerLock.Unlock()
+	k.externalHandlers = append(k.externalHandlers, fn)
+}
+
+// externalIPChanged applies the current external address of a family: an
+// IPv4 address gets a BEP 42 node ID, then the OnExternalIP callbacks and the
+// master channel are told. Changes are applied one at a time, a change
+// overtaken by a later one is only applied once.
+func (k *Kademila) externalIPChanged(ipv6 bool) {
+	c, _ := FromContext(k.ctx)
+	k.externalLock.Lock()
+	defer k.externalLock.Unlock()
+
+	ip := c.ExternalIP()
+	if ipv6 {
+		ip = c.ExternalIP6()
+	}
+	if ip == nil || ip.Equal(k.notified[ipv6]) {
+		return
+	}
+	k.notified[ipv6] = ip
+	if !ipv6 {
+		k.SetExternalIP(ip)
+	}
+	k.handlerLock.Lock()
+	handlers := k.externalHandlers
+	k.handlerLock.Unlock()
+	for _, fn := range handlers {
+		fn(ip)
+	}
+	go func() {
+		select {
+		case c.Master <- fmt.Sprintf("External IP changed: %s", ip):
+		case <-k.ctx.Done():
+		}
+	}()
+}
+
 func (k *Kademila) processError(m *Message) error {
 	c, _ := FromContext(k.ctx)
 	c.Log.WithFields(logrus.Fields{
 		"m": m.String(),
 	}).Warn("Error received:")
+	// The worker which sent the query marks the node as failed
+	k.forward(m)
 	return nil
 }
 
+// replyError answers a query which failed to decode, with 204 for an unknown
+// method and 203 for anything else.
+func (k *Kademila) replyError(m *Message, err error) {
+	c, _ := FromContext(k.ctx)
+	if c.Options.ReadOnly {
+		return
+	}
+	code := ProtocolError
+	desc := ErrorDefinitions[ProtocolError]
+	switch e := err.(type) {
+	case *MethodError:
+		code = MethodUnknown
+		desc = fmt.Sprintf("%s: %s", ErrorDefinitions[MethodUnknown], e.Method)
+	case *FieldError:
+		desc = fmt.Sprintf("%s: invalid `%s`, %s", desc, e.Field, e.What)
+	}
+	out := KRPCNewError(m.T, m.Q, code)
+	out.A.(*Err).Desc = desc
+	out.N = m.N
+	c.Outgoing <- out
+}
+
 func (k *Kademila) processMessage(m *Message) error {
 	switch m.Y {
 	case "q":
@@ -161,6 +469,24 @@ func (k *Kademila) processMessage(m *Message) error {
 func (k *Kademila) writeMessage(m *Message, addr net.Addr) {
 	c, _ := FromContext(k.ctx)
 
+	conn := c.Conn
+	if m.N.IsIPv6() {
+		conn = c.Conn6
+	}
+	if conn == nil {
+		c.Log.WithFields(logrus.Fields{
+			"destination": addr.String(),
+		}).Warn("No socket for address family")
+		return
+	}
+
+	if m.Y == "q" && m.T == "" {
+		k.transactions.start(m, nil)
+	}
+	if m.Y == "e" {
+		k.errors.add(m.A.(*Err).Code)
+	}
+	c.outgoing(m)
 	encoded, err := KRPCEncode(m)
 	if err != nil {
 		c.Log.WithFields(logrus.Fields{
@@ -169,7 +495,7 @@ func (k *Kademila) writeMessage(m *Message, addr net.Addr) {
 		return
 	}
 	var n int
-	n, err = c.Conn.WriteTo([]byte(encoded), addr)
+	n, err = conn.WriteTo([]byte(encoded), addr)
 	if err != nil {
 		c.Log.WithFields(logrus.Fields{
 			"length": len(encoded),
@@ -201,13 +527,12 @@ func (k *Kademila) outgoingLoop() {
 	}
 }
 
-func (k *Kademila) incomingLoop() {
+func (k *Kademila) incomingLoop(conn net.PacketConn) {
 	c, _ := FromContext(k.ctx)
 
-	buffer := make(map[string][]byte)
 	data := make([]byte, MAXSIZE)
 	for {
-		n, addr, err := c.Conn.ReadFrom(data)
+		n, addr, err := conn.ReadFrom(data)
 		if err != nil {
 			c.Log.WithFields(logrus.Fields{
 				"err": err,
@@ -219,37 +544,392 @@ func (k *Kademila) incomingLoop() {
 			"addr":  addr.String(),
 		}).Debug("Packet received")
 
-		if KRPCValidate(data[:n]) {
-			newdat := make([]byte, n)
-			copy(newdat, data[:n])
-			c.Incoming <- RawData{addr, newdat}
-		} else {
-			key := addr.String()
-			_, ok := buffer[key]
-			if !ok {
-				buffer[key] = make([]byte, n)
-				copy(buffer[key], data[:n])
-			} else {
-				cur := len(buffer[key])
-				newdat := make([]byte, cur+n)
-				copy(newdat, buffer[key])
-				copy(newdat[cur:], data[:n])
-				if KRPCValidate(newdat) {
-					c.Incoming <- RawData{addr, newdat}
-					delete(buffer, key)
-				} else {
-					buffer[key] = newdat
+		// Every datagram is a whole message, it is decoded once in mainLoop
+		newdat := make([]byte, n)
+		copy(newdat, data[:n])
+		c.Incoming <- RawData{addr, newdat}
+	}
+}
+
+type ArgumentError struct {
+	What string
+}
+
+func (e ArgumentError) Error() string {
+	return fmt.Sprintf("Invalid argument: %s", e.What)
+}
+
+// SaveError is the failure to write the file at Path.
+type SaveError struct {
+	Path string
+	Err  error
+}
+
+func (e *SaveError) Error() string {
+	return fmt.Sprintf("Save %s failed: %s", e.Path, e.Err)
+}
+
+func (e *SaveError) Unwrap() error {
+	return e.Err
+}
+
+// lookupNodes returns the starting nodes for a lookup of target in t, falling
+// back to the bootstrap nodes while the table is still sparse.
+func lookupNodes(t *table, target NodeID) []Node {
+	nodes := t.findNode(target.String())
+	if len(nodes) < K {
+		nodes = append(nodes, t.bootstrapNodes()...)
+	}
+	return nodes
+}
+
+// eachTable runs fn with a dedicated finder for every routing table in
+// parallel and waits for all of them, i is the index in k.tables().
+func (k *Kademila) eachTable(ctx context.Context, fn func(i int, t *table, f *finder)) {
+	tables := k.tables()
+	var wg sync.WaitGroup
+	for i := range tables {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			t := tables[i]
+			f, cancel := t.newLookup(ctx)
+			defer t.releaseLookup(f)
+			defer cancel()
+			fn(i, t, f)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// lookupPeers runs one get_peers lookup per routing table, the results are in
+// the order of k.tables().
+func (k *Kademila) lookupPeers(ctx context.Context, infoHash string, stream chan<- *Peer) ([]*GetPeersResult, error) {
+	if len(infoHash) != 20 {
+		return nil, ArgumentError{fmt.Sprintf("info hash would be 20 bytes, got %d", len(infoHash))}
+	}
+	target := NodeID(infoHash)
+	results := make([]*GetPeersResult, len(k.tables()))
+	k.eachTable(ctx, func(i int, t *table, f *finder) {
+		results[i] = f.getPeers(target, lookupNodes(t, target), stream)
+	})
+	return results, ctx.Err()
+}
+
+func (k *Kademila) getPeers(ctx context.Context, infoHash string, stream chan<- *Peer) (*GetPeersResult, error) {
+	results, err := k.lookupPeers(ctx, infoHash, stream)
+	if results == nil {
+		return nil, err
+	}
+	result := &GetPeersResult{InfoHash: NodeID(infoHash)}
+	for _, r := range results {
+		result.Peers = append(result.Peers, r.Peers...)
+		result.Nodes = append(result.Nodes, r.Nodes...)
+		result.Failed = append(result.Failed, r.Failed...)
+	}
+	return result, err
+}
+
+// GetPeers runs an iterative get_peers lookup for the raw 20 bytes infoHash
+// over IPv4 and IPv6, it returns the peers found and the responsive nodes
+// with their tokens.
+// A canceled ctx stops the lookup and returns the partial result.
+func (k *Kademila) GetPeers(ctx context.Context, infoHash string) (*GetPeersResult, error) {
+	return k.getPeers(ctx, infoHash, nil)
+}
+
+// GetPeersStream is like GetPeers but delivers every new peer as soon as it
+// is received. The channel is closed once the lookup is finished.
+func (k *Kademila) GetPeersStream(ctx context.Context, infoHash string) (<-chan *Peer, error) {
+	if len(infoHash) != 20 {
+		return nil, ArgumentError{fmt.Sprintf("info hash would be 20 bytes, got %d", len(infoHash))}
+	}
+	stream := make(chan *Peer)
+	go func() {
+		defer close(stream)
+		k.getPeers(ctx, infoHash, stream)
+	}()
+	return stream, nil
+}
+
+// AnnouncePeers announces that we are downloading infoHash on port. It looks
+// up the K closest responsive nodes first and sends announce_peer to each of
+// them with the token it handed out. With impliedPort the remote nodes use
+// our UDP source port instead of port.
+func (k *Kademila) AnnouncePeers(ctx context.Context, impliedPort bool, infoHash string, port int) (*AnnounceResult, error) {
+	lookups, err := k.lookupPeers(ctx, infoHash, nil)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]*AnnounceResult, len(lookups))
+	k.eachTable(ctx, func(i int, t *table, f *finder) {
+		results[i] = f.announcePeer(lookups[i].InfoHash, port, impliedPort, closest(lookups[i].Nodes))
+	})
+	result := &AnnounceResult{InfoHash: NodeID(infoHash)}
+	for i, r := range results {
+		result.Peers = append(result.Peers, lookups[i].Peers...)
+		result.Acked = append(result.Acked, r.Acked...)
+		result.Failed = append(result.Failed, r.Failed...)
+	}
+	return result, ctx.Err()
+}
+
+// closest returns the first K of the nodes sorted by distance which handed
+// out a token, a store without token would be refused anyway.
+func closest(nodes []TokenNode) []TokenNode {
+	var ret []TokenNode
+	for i := 0; i < len(nodes) && len(ret) < K; i++ {
+		if nodes[i].Token != "" {
+			ret = append(ret, nodes[i])
+		}
+	}
+	return ret
+}
+
+// Scrape estimates the number of seeds and downloaders of infoHash from the
+// BEP 33 bloom filters of the nodes close to it, without fetching peer lists.
+func (k *Kademila) Scrape(ctx context.Context, infoHash string) (*ScrapeResult, error) {
+	if len(infoHash) != 20 {
+		return nil, ArgumentError{fmt.Sprintf("info hash would be 20 bytes, got %d", len(infoHash))}
+	}
+	target := NodeID(infoHash)
+	bfsd := newBloomFilter()
+	bfpe := newBloomFilter()
+	lock := new(sync.Mutex)
+	result := &ScrapeResult{InfoHash: target}
+	k.eachTable(ctx, func(i int, t *table, f *finder) {
+		sd, pe, n := f.scrape(target, lookupNodes(t, target))
+		lock.Lock()
+		defer lock.Unlock()
+		bfsd.merge(sd)
+		bfpe.merge(pe)
+		result.Nodes += n
+	})
+	result.Seeds = bfsd.estimate()
+	result.Peers = bfpe.estimate()
+	return result, ctx.Err()
+}
+
+// recentSet remembers the keys added lately, once the current generation
+// holds size keys the previous one is forgotten.
+type recentSet struct {
+	size int
+	cur  map[string]bool
+	prev map[string]bool
+}
+
+func newRecentSet(size int) *recentSet {
+	s := new(recentSet)
+	s.size = size
+	s.cur = make(map[string]bool)
+	return s
+}
+
+// add returns false if key is still remembered.
+func (s *recentSet) add(key string) bool {
+	if s.cur[key] || s.prev[key] {
+		return false
+	}
+	if len(s.cur) >= s.size {
+		s.prev = s.cur
+		s.cur = make(map[string]bool)
+	}
+	s.cur[key] = true
+	return true
+}
+
+// CrawlInfoHashes walks the key space with BEP 51 sample_infohashes lookups
+// towards random targets and delivers the info hashes found. Only the last
+// CrawlSeenSize or so are remembered to skip duplicates, a caller which
+// needs every info hash exactly once has to keep its own record. Nodes are
+// not asked again before the interval they returned. The channel is closed
+// when ctx is done.
+func (k *Kademila) CrawlInfoHashes(ctx context.Context) <-chan NodeID {
+	stream := make(chan NodeID)
+	lock := new(sync.Mutex)
+	seen := newRecentSet(CrawlSeenSize)
+	emit := func(infoHash NodeID) {
+		lock.Lock()
+		added := seen.add(infoHash.String())
+		lock.Unlock()
+		if !added {
+			return
+		}
+		select {
+		case stream <- infoHash:
+		case <-ctx.Done():
+		}
+	}
+	go func() {
+		defer close(stream)
+		k.eachTable(ctx, func(i int, t *table, f *finder) {
+			skip := make(map[string]time.Time)
+			for ctx.Err() == nil {
+				target := GenerateID()
+				if len(f.sampleInfoHashes(target, lookupNodes(t, target), skip, emit)) == 0 {
+					// Nothing to ask yet, don't spin
+					select {
+					case <-time.After(time.Duration(NodeRefreshnessTimeLimit) * time.Second):
+					case <-ctx.Done():
+					}
+				}
+				now := time.Now()
+				for addr, next := range skip {
+					if now.After(next) {
+						delete(skip, addr)
+					}
 				}
 			}
+		})
+	}()
+	return stream
+}
+
+func (k *Kademila) lookupItem(ctx context.Context, target NodeID, salt []byte, mutable bool, all bool) []*GetItemResult {
+	results := make([]*GetItemResult, len(k.tables()))
+	k.eachTable(ctx, func(i int, t *table, f *finder) {
+		results[i] = f.getItem(target, salt, mutable, all, lookupNodes(t, target))
+	})
+	return results
+}
+
+// bestItem returns the valid item with the highest seq of the results.
+func bestItem(results []*GetItemResult) *Item {
+	var item *Item
+	for _, r := range results {
+		if r.Item != nil && (item == nil || r.Item.Seq > item.Seq) {
+			item = r.Item
 		}
 	}
+	return item
 }
 
-func (k *Kademila) GetPeers(infoHash string) {
+// GetImmutable looks up the immutable BEP 44 item stored under target, the
+// item is nil if it was not found.
+func (k *Kademila) GetImmutable(ctx context.Context, target NodeID) (*Item, error) {
+	if len(target) != 20 {
+		return nil, ArgumentError{fmt.Sprintf("target would be 20 bytes, got %d", len(target))}
+	}
+	return bestItem(k.lookupItem(ctx, target, nil, false, false)), ctx.Err()
 }
 
-func (k *Kademila) AnnouncePeers(impliedPort bool, infoHash string, port int, token string) {
+// GetMutable looks up the newest mutable BEP 44 item signed by key under
+// salt, the item is nil if it was not found.
+func (k *Kademila) GetMutable(ctx context.Context, key ed25519.PublicKey, salt []byte) (*Item, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return nil, ArgumentError{fmt.Sprintf("key would be %d bytes, got %d", ed25519.PublicKeySize, len(key))}
+	}
+	return bestItem(k.lookupItem(ctx, MutableTarget(key, salt), salt, true, true)), ctx.Err()
 }
 
-func (k *Kademila) Close() {
+// PutItem stores item on the K closest nodes of its target in every routing
+// table. For a mutable item cas makes the nodes store it only if their
+// current seq equals *cas.
+func (k *Kademila) PutItem(ctx context.Context, item *Item, cas *int64) (*PutResult, error) {
+	if len(item.V) > MaxItemSize || !item.Verify() {
+		return nil, ArgumentError{"invalid item"}
+	}
+	target := item.Target()
+	lookups := k.lookupItem(ctx, target, item.Salt, item.Mutable(), true)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	results := make([]*PutResult, len(lookups))
+	k.eachTable(ctx, func(i int, t *table, f *finder) {
+		results[i] = f.putItem(item, cas, closest(lookups[i].Nodes))
+	})
+	result := &PutResult{Target: target}
+	for _, r := range results {
+		result.Acked = append(result.Acked, r.Acked...)
+		result.Failed = append(result.Failed, r.Failed...)
+	}
+	return result, ctx.Err()
+}
+
+// ErrorCounts returns the number of KRPC errors sent so far by error code.
+func (k *Kademila) ErrorCounts() map[int]uint64 {
+	return k.errors.snapshot()
+}
+
+// RoutingTable returns a copy of the IPv4 routing table.
+func (k *Kademila) RoutingTable() *RoutingTable {
+	return k.routing.routingTable()
+}
+
+// RoutingTable6 is like RoutingTable for IPv6, nil if IPv6 is disabled.
+func (k *Kademila) RoutingTable6() *RoutingTable {
+	if k.routing6 == nil {
+		return nil
+	}
+	return k.routing6.routingTable()
+}
+
+// RejectedNodes returns the number of nodes the routing tables turned away
+// for exceeding Options.MaxNodesPerIP ("ip"), MaxNodesPerSubnetInBucket
+// ("bucket-subnet") or MaxNodesPerSubnet ("subnet").
+func (k *Kademila) RejectedNodes() map[string]uint64 {
+	ret := make(map[string]uint64)
+	for _, t := range k.tables() {
+		for limit, n := range t.rejections() {
+			ret[limit] += n
+		}
+	}
+	return ret
+}
+
+// SetExternalIP tells the node its external address, if the current node ID
+// is not valid for ip according to BEP 42 a new one is generated and the
+// routing tables are rebuilt around it in the background.
+func (k *Kademila) SetExternalIP(ip net.IP) {
+	c, _ := FromContext(k.ctx)
+	k.idLock.Lock()
+	defer k.idLock.Unlock()
+	old := c.LocalID()
+	if VerifyID(old, ip) {
+		return
+	}
+	id := GenerateSecureID(ip)
+	c.setLocalID(id)
+	c.Log.WithFields(logrus.Fields{
+		"ip":  ip.String(),
+		"old": old.HexString(),
+		"new": id.HexString(),
+	}).Info("Node ID regenerated for BEP 42")
+	if err := k.saveIdentity(); err != nil {
+		c.Log.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("Save identity failed")
+	}
+	go k.rebuild()
+}
+
+// rebuild rebuilds the routing tables around the current node ID and
+// bootstraps them again.
+func (k *Kademila) rebuild() {
+	c, _ := FromContext(k.ctx)
+	k.rebuildLock.Lock()
+	defer k.rebuildLock.Unlock()
+	id := c.LocalID()
+	for _, t := range k.tables() {
+		t.rebuild()
+		t.bootstrap(id)
+	}
+}
+
+// Close saves the identity to Options.IdentityPath and the snapshot to
+// Options.SnapshotPath if they are set. Both are saved even if one fails, the
+// first failure is returned as a *SaveError.
+func (k *Kademila) Close() error {
+	c, _ := FromContext(k.ctx)
+	var first error
+	if err := k.saveIdentity(); err != nil {
+		first = &SaveError{c.Options.IdentityPath, err}
+	}
+	if c.Options.SnapshotPath == "" {
+		return first
+	}
+	if err := k.saveSnapshot(); err != nil && first == nil {
+		first = &SaveError{c.Options.SnapshotPath, err}
+	}
+	return first
 }
@@ -0,0 +1,133 @@
+package kademila
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+// testKademila returns a node on testContext which is not started, its
+// replies pile up in Outgoing.
+func testKademila(t *testing.T, opts *Options) *Kademila {
+	ctx := testContext(t, opts)
+	return &Kademila{
+		ctx:          ctx,
+		routing:      newTable(ctx, false),
+		token:        newTokenBuilder(),
+		peers:        newPeerStore(),
+		items:        newItemStore(),
+		transactions: newTransactionManager(),
+		errors:       newErrorCounter(),
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	tests := []struct {
+		name string
+		// Our node is read-only
+		readOnly bool
+		// The querying node is read-only
+		ro      bool
+		replied bool
+		inTable bool
+	}{
+		{"query", false, false, true, true},
+		{"read-only querier", false, true, true, false},
+		{"read-only node", true, false, false, true},
+		{"both read-only", true, true, false, false},
+	}
+	for _, test := range tests {
+		opts := DefaultOptions()
+		opts.ReadOnly = test.readOnly
+		k := testKademila(t, opts)
+		c, _ := FromContext(k.ctx)
+		q := KRPCNewPing(GenerateID(), UndefinedWorker)
+		q.RO = test.ro
+		_, q = encodeDecode(t, q)
+		k.processQuery(q)
+
+		if replied := len(c.Outgoing) > 0; replied != test.replied {
+			t.Errorf("%s: replied %v, want %v", test.name, replied, test.replied)
+		}
+		if inTable := k.routing.len() > 0; inTable != test.inTable {
+			t.Errorf("%s: querier added %v, want %v", test.name, inTable, test.inTable)
+		}
+	}
+}
+
+func TestReplyError(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		readOnly bool
+		// 0 for no reply
+		code int
+	}{
+		{"bad query", "d1:ad2:id3:abc6:target20:aaaaaaaaaaaaaaaaaaaae1:q9:find_node1:t2:aa1:y1:qe", false, ProtocolError},
+		{"unknown method", "d1:ad2:id20:aaaaaaaaaaaaaaaaaaaae1:q3:foo1:t2:aa1:y1:qe", false, MethodUnknown},
+		{"read-only", "d1:ad2:id20:aaaaaaaaaaaaaaaaaaaae1:q3:foo1:t2:aa1:y1:qe", true, 0},
+	}
+	for _, test := range tests {
+		opts := DefaultOptions()
+		opts.ReadOnly = test.readOnly
+		k := testKademila(t, opts)
+		c, _ := FromContext(k.ctx)
+		m, err := KRPCDecode(&RawData{codecAddr, []byte(test.data)}, k.transactions)
+		if m == nil || err == nil {
+			t.Fatalf("%s: decoded %v, %v", test.name, m, err)
+		}
+		k.replyError(m, err)
+
+		if test.code == 0 {
+			if len(c.Outgoing) > 0 {
+				t.Errorf("%s: replied %v", test.name, <-c.Outgoing)
+			}
+			continue
+		}
+		if len(c.Outgoing) != 1 {
+			t.Fatalf("%s: %d replies, want 1", test.name, len(c.Outgoing))
+		}
+		out := <-c.Outgoing
+		e, ok := out.A.(*Err)
+		if out.Y != "e" || !ok || e.Code != test.code || out.T != "aa" || out.N.Addr != codecAddr {
+			t.Errorf("%s: replied %v, want error %d", test.name, out, test.code)
+		}
+	}
+}
+
+func TestErrorCounts(t *testing.T) {
+	k := testKademila(t, nil)
+	c, _ := FromContext(k.ctx)
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	c.Conn = conn
+
+	to := Node{ID: GenerateID(), Addr: peer.LocalAddr().(*net.UDPAddr)}
+	for _, code := range []int{ProtocolError, ProtocolError, MethodUnknown} {
+		m := KRPCNewError("aa", "ping", code)
+		m.N = to
+		k.writeMessage(m, to.Addr)
+	}
+	// Responses are not counted
+	m := KRPCNewPingResponse("aa", c.LocalID())
+	m.N = to
+	k.writeMessage(m, to.Addr)
+
+	want := map[int]uint64{ProtocolError: 2, MethodUnknown: 1}
+	if got := k.ErrorCounts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("counted %v, want %v", got, want)
+	}
+	// The counts are a copy
+	k.ErrorCounts()[ProtocolError] = 10
+	if got := k.ErrorCounts()[ProtocolError]; got != 2 {
+		t.Errorf("counted %d after changing a copy, want 2", got)
+	}
+}
@@ -4,10 +4,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"math"
 	"net"
-	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/zeebo/bencode"
@@ -25,11 +24,16 @@ type PingQuery struct {
 type FindNodeQuery struct {
 	ID     string
 	Target string
+	Want   []string
 }
 
 type GetPeersQuery struct {
 	ID       string
 	InfoHash string
+	Want     []string
+	// BEP 33
+	Scrape bool
+	NoSeed bool
 }
 
 type AnnouncePeerQuery struct {
@@ -38,6 +42,29 @@ type AnnouncePeerQuery struct {
 	InfoHash    string
 	Port        int
 	Token       string
+	// BEP 33, the announcing peer is a seed
+	Seed bool
+}
+
+type GetQuery struct {
+	ID     string
+	Target string
+	// Only return a mutable item newer than Seq
+	Seq  *int64
+	Want []string
+}
+
+type PutQuery struct {
+	ID    string
+	Token string
+	Item  *Item
+	Cas   *int64
+}
+
+type SampleInfoHashesQuery struct {
+	ID     string
+	Target string
+	Want   []string
 }
 
 type PingResponse struct {
@@ -45,8 +72,9 @@ type PingResponse struct {
 }
 
 type FindNodeResponse struct {
-	ID    string
-	Nodes []Node
+	ID     string
+	Nodes  []Node
+	Nodes6 []Node
 }
 
 type GetPeersResponse struct {
@@ -54,12 +82,40 @@ type GetPeersResponse struct {
 	Token  string
 	Values []*Peer
 	Nodes  []Node
+	Nodes6 []Node
+	// BEP 33 bloom filters of seeds and downloaders, for scrape queries
+	BFsd []byte
+	BFpe []byte
 }
 
 type AnnouncePeerResponse struct {
 	ID string
 }
 
+type GetResponse struct {
+	ID     string
+	Token  string
+	Nodes  []Node
+	Nodes6 []Node
+	// nil if the node does not store the target
+	Item *Item
+}
+
+type PutResponse struct {
+	ID string
+}
+
+type SampleInfoHashesResponse struct {
+	ID string
+	// Seconds the querying node should wait before asking again
+	Interval int
+	// Number of info hashes the node stores
+	Num     int
+	Samples []NodeID
+	Nodes   []Node
+	Nodes6  []Node
+}
+
 type Err struct {
 	Code int
 	Desc string
@@ -75,9 +131,17 @@ type Message struct {
 	//The string should be a two character client identifier registered in BEP 20 [3] followed by a two character version identifier.
 	//Not all implementations include a "v" key so clients should not assume its presence.
 	V string
-	Q string
-	W int
-	A interface{}
+	//Set by read-only nodes (BEP 43), which must not be added to routing tables.
+	RO bool
+	//Our address as seen by the sender of a response (BEP 42), nil if not given.
+	IP *net.UDPAddr
+	Q  string
+	W  int
+	A  interface{}
+	//Unknown keys of the message and of its `a` or `r` dictionary, kept raw
+	//and encoded back unchanged.
+	Extra     map[string]bencode.RawMessage
+	ExtraArgs map[string]bencode.RawMessage
 }
 
 func (q *PingQuery) String() string {
@@ -85,67 +149,137 @@ func (q *PingQuery) String() string {
 }
 
 func (q *FindNodeQuery) String() string {
-	return fmt.Sprintf("ID=%x, Target=%x", q.ID, q.Target)
+	return fmt.Sprintf("ID=%x, Target=%x, Want=%v", q.ID, q.Target, q.Want)
 }
 
 func (q *GetPeersQuery) String() string {
-	return fmt.Sprintf("ID=%x, InfoHash=%x", q.ID, q.InfoHash)
+	return fmt.Sprintf("ID=%x, InfoHash=%x, Want=%v, Scrape=%t, NoSeed=%t", q.ID, q.InfoHash, q.Want, q.Scrape, q.NoSeed)
 }
 
 func (q *AnnouncePeerQuery) String() string {
-	return fmt.Sprintf("ID=%x, InfoHash=%x, ImpliedPort=%t, Port=%d, Token=%x", q.ID, q.InfoHash, q.ImpliedPort, q.Port, q.Token)
+	return fmt.Sprintf("ID=%x, InfoHash=%x, ImpliedPort=%t, Port=%d, Token=%x, Seed=%t", q.ID, q.InfoHash, q.ImpliedPort, q.Port, q.Token, q.Seed)
+}
+
+func (q *GetQuery) String() string {
+	seq := "none"
+	if q.Seq != nil {
+		seq = strconv.FormatInt(*q.Seq, 10)
+	}
+	return fmt.Sprintf("ID=%x, Target=%x, Seq=%s, Want=%v", q.ID, q.Target, seq, q.Want)
+}
+
+func (q *PutQuery) String() string {
+	cas := "none"
+	if q.Cas != nil {
+		cas = strconv.FormatInt(*q.Cas, 10)
+	}
+	return fmt.Sprintf("ID=%x, Token=%x, Cas=%s, %s", q.ID, q.Token, cas, q.Item)
+}
+
+func (q *SampleInfoHashesQuery) String() string {
+	return fmt.Sprintf("ID=%x, Target=%x, Want=%v", q.ID, q.Target, q.Want)
 }
 
 func (r *PingResponse) String() string {
 	return fmt.Sprintf("ID=%x", r.ID)
 }
 
-func (r *FindNodeResponse) String() string {
+func formatNodes(list []Node) string {
 	nodes := ""
-	for i, n := range r.Nodes {
+	for i, n := range list {
 		s := fmt.Sprintf("<%d, ID=%x, Addr=%s>", i, n.ID, n.Addr.String())
 		nodes += s
-		if i < len(r.Nodes)-1 {
+		if i < len(list)-1 {
 			nodes += "; "
 		}
 	}
-	return fmt.Sprintf("ID=%x, Length=%d, Nodes=[%s]", r.ID, len(r.Nodes), nodes)
+	return nodes
+}
+
+// nodes returns the nodes of the requested address family.
+func (r *FindNodeResponse) nodes(ipv6 bool) []Node {
+	if ipv6 {
+		return r.Nodes6
+	}
+	return r.Nodes
+}
+
+func (r *FindNodeResponse) String() string {
+	return fmt.Sprintf("ID=%x, Length=%d, Nodes=[%s], Nodes6=[%s]", r.ID, len(r.Nodes)+len(r.Nodes6), formatNodes(r.Nodes), formatNodes(r.Nodes6))
 }
 
 func (r *GetPeersResponse) String() string {
 	values := ""
 	for i, p := range r.Values {
-		s := fmt.Sprintf("<%d, Addr=%s:%d>", i, p.IP.String(), p.Port)
+		s := fmt.Sprintf("<%d, %s>", i, p)
 		values += s
 		if i < len(r.Values)-1 {
 			values += "; "
 		}
 	}
-	nodes := ""
-	for i, n := range r.Nodes {
-		s := fmt.Sprintf("<%d, ID=%x, Addr=%s>", i, n.ID, n.Addr.String())
-		nodes += s
-		if i < len(r.Nodes)-1 {
-			nodes += "; "
-		}
+	return fmt.Sprintf("ID=%x, Token=%x, Values=[%s], Nodes=[%s], Nodes6=[%s], BFsd=%d, BFpe=%d", r.ID, r.Token, values, formatNodes(r.Nodes), formatNodes(r.Nodes6), len(r.BFsd), len(r.BFpe))
+}
+
+// nodes returns the nodes of the requested address family.
+func (r *GetPeersResponse) nodes(ipv6 bool) []Node {
+	if ipv6 {
+		return r.Nodes6
 	}
-	return fmt.Sprintf("ID=%x, Token=%x, Values=[%s], Nodes=[%s]", r.ID, r.Token, values, nodes)
+	return r.Nodes
 }
 
 func (r *AnnouncePeerResponse) String() string {
 	return fmt.Sprintf("ID=%x", r.ID)
 }
 
+func (r *GetResponse) String() string {
+	item := "none"
+	if r.Item != nil {
+		item = r.Item.String()
+	}
+	return fmt.Sprintf("ID=%x, Token=%x, Item=<%s>, Nodes=[%s], Nodes6=[%s]", r.ID, r.Token, item, formatNodes(r.Nodes), formatNodes(r.Nodes6))
+}
+
+// nodes returns the nodes of the requested address family.
+func (r *GetResponse) nodes(ipv6 bool) []Node {
+	if ipv6 {
+		return r.Nodes6
+	}
+	return r.Nodes
+}
+
+func (r *PutResponse) String() string {
+	return fmt.Sprintf("ID=%x", r.ID)
+}
+
+func (r *SampleInfoHashesResponse) String() string {
+	return fmt.Sprintf("ID=%x, Interval=%d, Num=%d, Samples=%d, Nodes=[%s], Nodes6=[%s]", r.ID, r.Interval, r.Num, len(r.Samples), formatNodes(r.Nodes), formatNodes(r.Nodes6))
+}
+
+// nodes returns the nodes of the requested address family.
+func (r *SampleInfoHashesResponse) nodes(ipv6 bool) []Node {
+	if ipv6 {
+		return r.Nodes6
+	}
+	return r.Nodes
+}
+
 func (e *Err) String() string {
 	return fmt.Sprintf("Code=%d, Desc=%s", e.Code, e.Desc)
 }
 
+func (e *Err) Error() string {
+	return fmt.Sprintf("KRPC error %d: %s", e.Code, e.Desc)
+}
+
 func (m *Message) String() string {
 	var additional string
 
 	if m.Y == "e" {
 		e := m.A.(*Err)
 		additional = e.String()
+	} else if m.Y == YTimeout {
+		additional = m.A.(TimeoutError).Error()
 	} else {
 		switch m.Q {
 		case "ping":
@@ -172,6 +306,24 @@ func (m *Message) String() string {
 			} else {
 				additional = m.A.(*AnnouncePeerResponse).String()
 			}
+		case "get":
+			if m.Y == "q" {
+				additional = m.A.(*GetQuery).String()
+			} else {
+				additional = m.A.(*GetResponse).String()
+			}
+		case "put":
+			if m.Y == "q" {
+				additional = m.A.(*PutQuery).String()
+			} else {
+				additional = m.A.(*PutResponse).String()
+			}
+		case "sample_infohashes":
+			if m.Y == "q" {
+				additional = m.A.(*SampleInfoHashesQuery).String()
+			} else {
+				additional = m.A.(*SampleInfoHashesResponse).String()
+			}
 		}
 	}
 	ver := formatVersion(m.V)
@@ -200,51 +352,89 @@ var ServerError = 202
 var ProtocolError = 203
 var MethodUnknown = 204
 
+// BEP 44
+var MessageTooBig = 205
+var InvalidSignature = 206
+var SaltTooBig = 207
+var CasMismatch = 301
+var SequenceTooSmall = 302
+
 var ErrorDefinitions = map[int]string{
-	GenericError:  "Generic Error",
-	ServerError:   "Server Error",
-	ProtocolError: "Protocol Error",
-	MethodUnknown: "Method Unknown",
+	GenericError:     "Generic Error",
+	ServerError:      "Server Error",
+	ProtocolError:    "Protocol Error",
+	MethodUnknown:    "Method Unknown",
+	MessageTooBig:    "Message (v field) too big",
+	InvalidSignature: "Invalid signature",
+	SaltTooBig:       "Salt (salt field) too big",
+	CasMismatch:      "The CAS hash mismatched, re-read value and try again",
+	SequenceTooSmall: "Sequence number less than current",
 }
 
-var lock = new(sync.Mutex)
+// errorCounter counts KRPC errors by code.
+type errorCounter struct {
+	lock   sync.Mutex
+	counts map[int]uint64
+}
 
-type queryMetadata struct {
-	q string
-	w int
+func newErrorCounter() *errorCounter {
+	return &errorCounter{counts: make(map[int]uint64)}
 }
 
-var penddingRequests = make(map[string]queryMetadata)
-var transactionID uint64
+func (ec *errorCounter) add(code int) {
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	ec.counts[code]++
+}
 
-func genTID() string {
-	transactionID++
-	tid := uint16(transactionID % math.MaxUint16)
-	bs := make([]byte, 2)
-	binary.BigEndian.PutUint16(bs, tid)
-	return string(bs)
+func (ec *errorCounter) snapshot() map[int]uint64 {
+	ec.lock.Lock()
+	defer ec.lock.Unlock()
+	ret := make(map[int]uint64, len(ec.counts))
+	for code, n := range ec.counts {
+		ret[code] = n
+	}
+	return ret
 }
 
 func convertIPPort(buf *bytes.Buffer, ip net.IP, port int) {
-	if ip.IsUnspecified() {
-		buf.Write(net.ParseIP("127.0.0.1").To4())
+	if ip4 := ip.To4(); ip4 != nil {
+		if ip4.IsUnspecified() {
+			ip4 = net.ParseIP("127.0.0.1").To4()
+		}
+		buf.Write(ip4)
+	} else if ip.IsUnspecified() {
+		buf.Write(net.IPv6loopback)
 	} else {
-		buf.Write(ip.To4())
+		buf.Write(ip.To16())
 	}
 	bs := make([]byte, 2)
 	binary.BigEndian.PutUint16(bs, uint16(port))
 	buf.Write(bs)
 }
 
-func ConvertNodeToBytes(nodes []Node) []byte {
+func convertNodes(nodes []Node, ipv6 bool) []byte {
 	buf := bytes.NewBuffer(nil)
 	for _, v := range nodes {
+		if v.IsIPv6() != ipv6 {
+			continue
+		}
 		buf.Write(v.ID)
 		convertIPPort(buf, v.IP(), v.Port())
 	}
 	return buf.Bytes()
 }
 
+// ConvertNodeToBytes encodes the IPv4 nodes in compact 26 bytes format.
+func ConvertNodeToBytes(nodes []Node) []byte {
+	return convertNodes(nodes, false)
+}
+
+// ConvertNode6ToBytes encodes the IPv6 nodes in compact 38 bytes format (BEP 32).
+func ConvertNode6ToBytes(nodes []Node) []byte {
+	return convertNodes(nodes, true)
+}
+
 func ConvertPeerToBytes(peers []*Peer) []string {
 	var ret []string
 
@@ -256,17 +446,18 @@ func ConvertPeerToBytes(peers []*Peer) []string {
 	return ret
 }
 
-func ParseNodes(sn string) []Node {
+func parseNodes(sn string, iplen int) []Node {
 	data := []byte(sn)
+	size := 20 + iplen + 2
 	var nodes []Node
-	for j := 0; j < len(data); j = j + 26 {
-		if j+26 > len(data) {
+	for j := 0; j < len(data); j = j + size {
+		if j+size > len(data) {
 			break
 		}
-		kn := data[j : j+26]
+		kn := data[j : j+size]
 		ID := NodeID(kn[0:20])
-		IP := kn[20:24]
-		port := kn[24:26]
+		IP := net.IP(kn[20 : 20+iplen])
+		port := kn[20+iplen : size]
 		Port := int(port[0])<<8 + int(port[1])
 		Addr := &net.UDPAddr{IP: IP, Port: Port}
 		nodes = append(nodes, Node{ID: ID, Addr: Addr, Status: INIT})
@@ -274,22 +465,65 @@ func ParseNodes(sn string) []Node {
 	return nodes
 }
 
+// ParseNodes decodes the compact IPv4 node info of the `nodes` field.
+func ParseNodes(sn string) []Node {
+	return parseNodes(sn, net.IPv4len)
+}
+
+// ParseNodes6 decodes the compact IPv6 node info of the `nodes6` field.
+func ParseNodes6(sn string) []Node {
+	return parseNodes(sn, net.IPv6len)
+}
+
 func ParsePeers(peers []string) ([]*Peer, error) {
 	var ret []*Peer
 	for _, peer := range peers {
 		data := []byte(peer)
-		if len(data) != 6 {
-			return nil, &DecodeError{"Protocol error: peer length would be 6 bytes, got " + strconv.Itoa(len(data))}
+		if len(data) != 6 && len(data) != 18 {
+			return nil, &DecodeError{"Protocol error: peer length would be 6 or 18 bytes, got " + strconv.Itoa(len(data))}
 		}
 		p := new(Peer)
-		p.IP = data[:4]
-		port := data[4:]
+		p.IP = data[:len(data)-2]
+		port := data[len(data)-2:]
 		p.Port = int(port[0])<<8 + int(port[1])
 		ret = append(ret, p)
 	}
 	return ret, nil
 }
 
+// parseCompactAddr decodes a compact IPv4 or IPv6 address and port.
+func parseCompactAddr(s string) (*net.UDPAddr, error) {
+	if len(s) != 6 && len(s) != 18 {
+		return nil, &DecodeError{"Protocol error: address length would be 6 or 18 bytes, got " + strconv.Itoa(len(s))}
+	}
+	data := []byte(s)
+	port := data[len(data)-2:]
+	return &net.UDPAddr{IP: net.IP(data[:len(data)-2]), Port: int(port[0])<<8 + int(port[1])}, nil
+}
+
+// clientVersion builds the 4 bytes `v` of BEP 20: the first and the last
+// capital letter of name followed by the major and minor version numbers.
+func clientVersion(name string, version string) string {
+	var caps []byte
+	for i := 0; i < len(name); i++ {
+		if name[i] >= 'A' && name[i] <= 'Z' {
+			caps = append(caps, name[i])
+		}
+	}
+	if len(caps) == 0 {
+		return ""
+	}
+	v := []byte{caps[0], caps[len(caps)-1], 0, 0}
+	for i, n := range strings.SplitN(version, ".", 3) {
+		if i > 1 {
+			break
+		}
+		num, _ := strconv.Atoi(n)
+		v[2+i] = byte(num)
+	}
+	return string(v)
+}
+
 func formatVersion(ver string) string {
 	if len(ver) > 1 {
 		v := ""
@@ -308,270 +542,6 @@ func validateClient(ver string) bool {
 	return !found
 }
 
-func decodeQuery(addition map[string]interface{}, m *Message) error {
-	var ok bool
-	var emsg string
-
-	switch m.Q {
-	case "ping":
-		payload := new(PingQuery)
-		payload.ID, ok = addition["id"].(string)
-		if !ok {
-			emsg = "Invalid `id` field"
-			break
-		}
-		m.N.ID = []byte(payload.ID)
-		m.A = payload
-	case "find_node":
-		payload := new(FindNodeQuery)
-		payload.ID, ok = addition["id"].(string)
-		if !ok {
-			emsg = "Invalid `id` field"
-			break
-		}
-		payload.Target, ok = addition["target"].(string)
-		if !ok {
-			emsg = "Invalid `target` field"
-			break
-		}
-		m.N.ID = []byte(payload.ID)
-		m.A = payload
-	case "get_peers":
-		payload := new(GetPeersQuery)
-		payload.ID, ok = addition["id"].(string)
-		if !ok {
-			emsg = "Invalid `id` field"
-			break
-		}
-		payload.InfoHash, ok = addition["info_hash"].(string)
-		if !ok {
-			emsg = "Invalid `infohash` field"
-			break
-		}
-		m.N.ID = []byte(payload.ID)
-		m.A = payload
-	case "announce_peer":
-		payload := new(AnnouncePeerQuery)
-		payload.ID, ok = addition["id"].(string)
-		if !ok {
-			emsg = "Invalid `id` field"
-			break
-		}
-		payload.InfoHash, ok = addition["info_hash"].(string)
-		if !ok {
-			emsg = "Invalid `infohash` field"
-			break
-		}
-		payload.Token, ok = addition["token"].(string)
-		if !ok {
-			emsg = "Invalid `token` field"
-			break
-		}
-		var impliedPort int64
-		impliedPort, ok = addition["implied_port"].(int64)
-		if !ok {
-			impliedPort = 0
-			ok = true
-		}
-		payload.ImpliedPort = (impliedPort != 0)
-		if payload.ImpliedPort {
-			payload.Port = m.N.Port()
-		} else {
-			p64, ok := addition["port"].(int64)
-			if !ok {
-				emsg = "Invalid `port` field"
-				break
-			}
-			payload.Port = int(p64)
-		}
-		m.N.ID = []byte(payload.ID)
-		m.A = payload
-	default:
-		return &DecodeError{"Unknown method: " + m.Q}
-	}
-	if !ok {
-		return &DecodeError{"Protocol error: " + m.Q + ", detail: " + emsg}
-	}
-	return nil
-}
-
-func decodeResponse(addition map[string]interface{}, m *Message) error {
-	var ok bool
-	var emsg string
-	var err error
-
-	switch m.Q {
-	case "ping":
-		payload := new(PingResponse)
-		payload.ID, ok = addition["id"].(string)
-		if !ok {
-			emsg = "Invalid `id` field"
-			break
-		}
-		m.N.ID = []byte(payload.ID)
-		m.A = payload
-	case "find_node":
-		payload := new(FindNodeResponse)
-		payload.ID, ok = addition["id"].(string)
-		if !ok {
-			emsg = "Invalid `id` field"
-			break
-		}
-		var sn string
-		sn, ok = addition["nodes"].(string)
-		if !ok {
-			emsg = "Invalid `nodes` field"
-			break
-		}
-		payload.Nodes = ParseNodes(sn)
-		m.N.ID = []byte(payload.ID)
-		m.A = payload
-	case "get_peers":
-		payload := new(GetPeersResponse)
-		payload.ID, ok = addition["id"].(string)
-		if !ok {
-			emsg = "Invalid `id` field"
-			break
-		}
-		payload.Token, ok = addition["token"].(string)
-		if !ok {
-			emsg = "Invalid `token` field"
-			break
-		}
-		var values []string
-		values, ok = addition["values"].([]string)
-		if ok {
-			payload.Values, err = ParsePeers(values)
-			if err != nil {
-				return err
-			}
-		}
-		var sn string
-		sn, ok = addition["nodes"].(string)
-		if ok {
-			payload.Nodes = ParseNodes(sn)
-		}
-		if len(payload.Values) == 0 && len(payload.Nodes) == 0 {
-			ok = false
-			emsg = "Invalid `values` field or `nodes` field"
-			break
-		}
-		m.N.ID = []byte(payload.ID)
-		m.A = payload
-	case "announce_peer":
-		payload := new(AnnouncePeerResponse)
-		payload.ID, ok = addition["id"].(string)
-		if !ok {
-			emsg = "Invalid `id` field"
-			break
-		}
-		m.N.ID = []byte(payload.ID)
-		m.A = payload
-	}
-	if !ok {
-		return &DecodeError{"Protocol error: " + m.Q + ", detail: " + emsg}
-	}
-	return nil
-}
-
-func KRPCValidate(data []byte) bool {
-	val := make(map[string]interface{})
-	err := bencode.DecodeBytes(data, &val)
-	return (err == nil)
-}
-
-func KRPCDecode(raw *RawData) (*Message, error) {
-	val := make(map[string]interface{})
-	var ok bool
-	var err error
-
-	if err = bencode.DecodeBytes(raw.Data, &val); err != nil {
-		return nil, &DecodeError{fmt.Sprintf("bencode error: %s, %s, %d", err.Error(), string(raw.Data), len(raw.Data))}
-	}
-
-	m := new(Message)
-	m.N.Addr = raw.Addr
-	m.W = UndefinedWorker
-	m.T, ok = val["t"].(string)
-	if !ok {
-		return nil, &DecodeError{"Protocol error: Empty `t` field"}
-	}
-	m.Y, ok = val["y"].(string)
-	if !ok {
-		return nil, &DecodeError{"Protocol error: Empty `y` field"}
-	}
-	m.V, ok = val["v"].(string)
-	if !ok {
-		m.V = ""
-	}
-	switch m.Y {
-	case "q":
-		m.Q, ok = val["q"].(string)
-		if !ok {
-			return nil, &DecodeError{"Protocol error: Empty query `q` field"}
-		}
-		var addition map[string]interface{}
-		addition, ok = val["a"].(map[string]interface{})
-		if !ok {
-			return nil, &DecodeError{"Protocol error: Empty query `a` field"}
-		}
-		err = decodeQuery(addition, m)
-		if err != nil {
-			return nil, err
-		}
-	case "r":
-		lock.Lock()
-		defer lock.Unlock()
-		qm, ok := penddingRequests[m.T]
-		if !ok {
-			return nil, &DecodeError{"Unknown request"}
-		}
-		m.Q = qm.q
-		m.W = qm.w
-		var addition map[string]interface{}
-		addition, ok = val["r"].(map[string]interface{})
-		if !ok {
-			return nil, &DecodeError{"Protocol error: Empty response `r` field"}
-		}
-		err = decodeResponse(addition, m)
-		if err != nil {
-			return nil, err
-		}
-	case "e":
-		lock.Lock()
-		defer lock.Unlock()
-		qm, ok := penddingRequests[m.T]
-		if !ok {
-			return nil, &DecodeError{"Unknown request"}
-		}
-		m.Q = qm.q
-		m.W = qm.w
-		err := new(Err)
-		var decodeErr []interface{}
-		decodeErr, ok = val["e"].([]interface{})
-		if !ok {
-			return nil, &DecodeError{"Protocol error: Empty error `e` field"}
-		}
-		if len(decodeErr) != 2 {
-			return nil, &DecodeError{"Protocol error: Error field length would be 2, got " + strconv.Itoa(len(decodeErr))}
-		}
-		c64, ok := decodeErr[0].(int64)
-		if !ok {
-			return nil, &DecodeError{fmt.Sprintf("Protocol error: Invalid Error code type, dat = %v, %s, %s", decodeErr, reflect.TypeOf(decodeErr[0]), reflect.TypeOf(decodeErr[1]))}
-		}
-		err.Code = int(c64)
-		err.Desc, ok = decodeErr[1].(string)
-		if !ok {
-			return nil, &DecodeError{"Protocol error: Invalid Error description type"}
-		}
-		m.A = err
-	default:
-		return nil, &DecodeError{"Protocol error: Unknown `y` value " + m.Y}
-	}
-
-	return m, nil
-}
-
 func KRPCNewError(tid string, q string, code int) *Message {
 	m := new(Message)
 	m.T = tid
@@ -620,7 +590,7 @@ func KRPCNewFindNode(local NodeID, target NodeID, worker int) *Message {
 	return m
 }
 
-func KRPCNewFindNodeResponse(tid string, local NodeID, nodes []Node) *Message {
+func KRPCNewFindNodeResponse(tid string, local NodeID, nodes []Node, nodes6 []Node) *Message {
 	m := new(Message)
 	m.T = tid
 	m.Y = "r"
@@ -629,6 +599,7 @@ func KRPCNewFindNodeResponse(tid string, local NodeID, nodes []Node) *Message {
 	payload := new(FindNodeResponse)
 	payload.ID = local.String()
 	payload.Nodes = nodes
+	payload.Nodes6 = nodes6
 	m.A = payload
 	return m
 }
@@ -645,7 +616,7 @@ func KRPCNewGetPeers(local NodeID, infoHash NodeID, worker int) *Message {
 	return m
 }
 
-func KRPCNewGetPeersResponse(tid string, local NodeID, token string, nodes []Node, values []*Peer) *Message {
+func KRPCNewGetPeersResponse(tid string, local NodeID, token string, nodes []Node, nodes6 []Node, values []*Peer) *Message {
 	m := new(Message)
 	m.T = tid
 	m.Y = "r"
@@ -654,6 +625,7 @@ func KRPCNewGetPeersResponse(tid string, local NodeID, token string, nodes []Nod
 	payload := new(GetPeersResponse)
 	payload.ID = local.String()
 	payload.Nodes = nodes
+	payload.Nodes6 = nodes6
 	payload.Values = values
 	payload.Token = token
 	m.A = payload
@@ -687,171 +659,86 @@ func KRPCNewAnnouncePeerResponse(tid string, local NodeID) *Message {
 	return m
 }
 
-func KRPCEncode(m *Message) (string, error) {
-	var ret string
-	var err error
-
-	switch m.Y {
-	case "q":
-		tid := genTID()
-
-		switch m.Q {
-		case "ping":
-			a := m.A.(*PingQuery)
-			ret, err = KRPCEncodePing(tid, a.ID)
-		case "find_node":
-			a := m.A.(*FindNodeQuery)
-			ret, err = KRPCEncodeFindNode(tid, a.ID, a.Target)
-		case "get_peers":
-			a := m.A.(*GetPeersQuery)
-			ret, err = KRPCEncodeGetPeers(tid, a.ID, a.InfoHash)
-		case "announce_peer":
-			a := m.A.(*AnnouncePeerQuery)
-			ret, err = KRPCEncodeAnnouncePeer(tid, a.ID, a.InfoHash, a.Port, a.Token, a.ImpliedPort)
-		}
-		if err == nil {
-			lock.Lock()
-			defer lock.Unlock()
-			penddingRequests[tid] = queryMetadata{m.Q, m.W}
-		}
-		m.T = tid
-
-	case "r":
-		switch m.Q {
-		case "ping":
-			a := m.A.(*PingResponse)
-			ret, err = KRPCEncodePingResponse(m.T, a.ID)
-		case "find_node":
-			a := m.A.(*FindNodeResponse)
-			ret, err = KRPCEncodeFindNodeResponse(m.T, a.ID, a.Nodes)
-		case "get_peers":
-			a := m.A.(*GetPeersResponse)
-			ret, err = KRPCEncodeGetPeersResponse(m.T, a.ID, a.Token, a.Nodes, a.Values)
-		case "announce_peer":
-		}
-
-	case "e":
-		a := m.A.(*Err)
-		ret, err = KRPCEncodeError(m.T, a.Code, a.Desc)
-	}
-	return ret, err
-}
-
-func KRPCEncodeError(tid string, code int, desc string) (string, error) {
-	v := make(map[string]interface{})
-	v["t"] = tid
-	v["y"] = "e"
-	e := make([]interface{}, 2)
-	e[0] = code
-	e[1] = desc
-	v["e"] = e
-	s, err := bencode.EncodeString(v)
-	return s, err
-}
-
-func KRPCEncodePing(tid string, local string) (string, error) {
-	v := make(map[string]interface{})
-	v["t"] = tid
-	v["y"] = "q"
-	v["q"] = "ping"
-	v["a"] = map[string]string{
-		"id": local,
-	}
-	s, err := bencode.EncodeString(v)
-	return s, err
+func KRPCNewGet(local NodeID, target NodeID, seq *int64, worker int) *Message {
+	m := new(Message)
+	m.Y = "q"
+	m.Q = "get"
+	m.W = worker
+	payload := new(GetQuery)
+	payload.ID = local.String()
+	payload.Target = target.String()
+	payload.Seq = seq
+	m.A = payload
+	return m
 }
 
-func KRPCEncodePingResponse(tid string, local string) (string, error) {
-	v := make(map[string]interface{})
-	v["t"] = tid
-	v["y"] = "r"
-	v["r"] = map[string]string{
-		"id": local,
-	}
-	s, err := bencode.EncodeString(v)
-	return s, err
-}
-
-func KRPCEncodeFindNode(tid string, local string, target string) (string, error) {
-	v := make(map[string]interface{})
-	v["t"] = tid
-	v["y"] = "q"
-	v["q"] = "find_node"
-	v["a"] = map[string]string{
-		"id":     local,
-		"target": target,
-	}
-	s, err := bencode.EncodeString(v)
-	return s, err
+func KRPCNewGetResponse(tid string, local NodeID, token string, nodes []Node, nodes6 []Node, item *Item) *Message {
+	m := new(Message)
+	m.T = tid
+	m.Y = "r"
+	m.Q = "get"
+	m.W = UndefinedWorker
+	payload := new(GetResponse)
+	payload.ID = local.String()
+	payload.Token = token
+	payload.Nodes = nodes
+	payload.Nodes6 = nodes6
+	payload.Item = item
+	m.A = payload
+	return m
 }
 
-func KRPCEncodeFindNodeResponse(tid string, local string, nodes []Node) (string, error) {
-	v := make(map[string]interface{})
-	v["t"] = tid
-	v["y"] = "r"
-	v["r"] = map[string]string{
-		"id":    local,
-		"nodes": string(ConvertNodeToBytes(nodes)),
-	}
-	s, err := bencode.EncodeString(v)
-	return s, err
-}
-
-func KRPCEncodeGetPeers(tid string, local string, infoHash string) (string, error) {
-	v := make(map[string]interface{})
-	v["t"] = tid
-	v["y"] = "q"
-	v["q"] = "get_peers"
-	v["a"] = map[string]string{
-		"id":        local,
-		"info_hash": infoHash,
-	}
-	s, err := bencode.EncodeString(v)
-	return s, err
-}
-
-func KRPCEncodeGetPeersResponse(tid string, local string, token string, nodes []Node, values []*Peer) (string, error) {
-	v := make(map[string]interface{})
-	v["t"] = tid
-	v["y"] = "r"
-	v["r"] = map[string]interface{}{
-		"id":     local,
-		"token":  token,
-		"nodes":  ConvertNodeToBytes(nodes),
-		"values": ConvertPeerToBytes(values),
-	}
-	s, err := bencode.EncodeString(v)
-	return s, err
+func KRPCNewPut(local NodeID, token string, item *Item, cas *int64, worker int) *Message {
+	m := new(Message)
+	m.Y = "q"
+	m.Q = "put"
+	m.W = worker
+	payload := new(PutQuery)
+	payload.ID = local.String()
+	payload.Token = token
+	payload.Item = item
+	payload.Cas = cas
+	m.A = payload
+	return m
 }
 
-func KRPCEncodeAnnouncePeer(tid string, local string, infoHash string, port int, token string, impliedPort bool) (string, error) {
-	v := make(map[string]interface{})
-	v["t"] = tid
-	v["y"] = "q"
-	v["q"] = "announce_peer"
+func KRPCNewPutResponse(tid string, local NodeID) *Message {
+	m := new(Message)
+	m.T = tid
+	m.Y = "r"
+	m.Q = "put"
+	m.W = UndefinedWorker
+	payload := new(PutResponse)
+	payload.ID = local.String()
+	m.A = payload
+	return m
+}
 
-	imp := 0
-	if impliedPort {
-		imp = 1
-	}
-	v["a"] = map[string]interface{}{
-		"id":           local,
-		"implied_port": imp,
-		"info_hash":    infoHash,
-		"port":         port,
-		"token":        token,
-	}
-	s, err := bencode.EncodeString(v)
-	return s, err
+func KRPCNewSampleInfoHashes(local NodeID, target NodeID, worker int) *Message {
+	m := new(Message)
+	m.Y = "q"
+	m.Q = "sample_infohashes"
+	m.W = worker
+	payload := new(SampleInfoHashesQuery)
+	payload.ID = local.String()
+	payload.Target = target.String()
+	m.A = payload
+	return m
 }
 
-func KRPCEncodeAnnouncePeerResponse(tid string, local string) (string, error) {
-	v := make(map[string]interface{})
-	v["t"] = tid
-	v["y"] = "r"
-	v["r"] = map[string]string{
-		"id": local,
-	}
-	s, err := bencode.EncodeString(v)
-	return s, err
+func KRPCNewSampleInfoHashesResponse(tid string, local NodeID, interval int, num int, samples []NodeID, nodes []Node, nodes6 []Node) *Message {
+	m := new(Message)
+	m.T = tid
+	m.Y = "r"
+	m.Q = "sample_infohashes"
+	m.W = UndefinedWorker
+	payload := new(SampleInfoHashesResponse)
+	payload.ID = local.String()
+	payload.Interval = interval
+	payload.Num = num
+	payload.Samples = samples
+	payload.Nodes = nodes
+	payload.Nodes6 = nodes6
+	m.A = payload
+	return m
 }
@@ -0,0 +1,22 @@
+package kademila
+
+import "testing"
+
+func TestClientVersion(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		want    string
+	}{
+		{APPNAME, VERSION, "DR\x00\x01"},
+		{"DHTRobot", "2.13", "DR\x02\x0d"},
+		{"DHTRobot", "", "DR\x00\x00"},
+		{"Transmission", "1.x", "TT\x01\x00"},
+		{"dhtrobot", "1.0", ""},
+	}
+	for _, test := range tests {
+		if got := clientVersion(test.name, test.version); got != test.want {
+			t.Errorf("%s %s: got %q, want %q", test.name, test.version, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package kademila
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TokenNode is a node which answered a token issuing query (get_peers, get)
+// together with the token it handed out for a later announce_peer or put.
+type TokenNode struct {
+	Node
+	Token string
+}
+
+// GetPeersResult is the outcome of an iterative get_peers lookup.
+type GetPeersResult struct {
+	InfoHash NodeID
+	Peers    []*Peer
+	// Responsive nodes, closest to InfoHash first
+	Nodes []TokenNode
+	// Nodes which replied with a KRPC error or timed out
+	Failed []NodeError
+}
+
+type TimeoutError struct {
+	What string
+}
+
+func (e TimeoutError) Error() string {
+	return fmt.Sprintf("Timeout: %s", e.What)
+}
+
+// NodeError is a node which failed a request, Err is either the *Err it
+// replied with or a TimeoutError.
+type NodeError struct {
+	Node Node
+	Err  error
+}
+
+// AnnounceResult is the outcome of an announce_peer round.
+type AnnounceResult struct {
+	InfoHash NodeID
+	// Peers found by the preceding get_peers lookup
+	Peers []*Peer
+	// Nodes which acknowledged the announce
+	Acked  []Node
+	Failed []NodeError
+}
+
+type lookupNode struct {
+	node  Node
+	token string
+}
+
+// lookupReply is what a lookup learned from one response.
+type lookupReply struct {
+	Token string
+	Nodes []Node
+	// The lookup has its answer and should not go any further
+	Stop bool
+}
+
+func xorCompare(target, a, b NodeID) int {
+	if len(a) == 0 || len(b) == 0 {
+		// Nodes we only know by address (bootstrap) sort last
+		return len(b) - len(a)
+	}
+	return XOR(target, a).Cmp(XOR(target, b))
+}
+
+func sortLookupNodes(target NodeID, candidates map[string]*lookupNode, status ...uint8) []*lookupNode {
+	var ret []*lookupNode
+	for _, ln := range candidates {
+		for _, s := range status {
+			if ln.node.Status == s {
+				ret = append(ret, ln)
+				break
+			}
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return xorCompare(target, ret[i].node.ID, ret[j].node.ID) < 0
+	})
+	return ret
+}
+
+// Candidates are INIT until queried, QUESTIONABLE while in flight, GOOD once
+// they answered and BAD once their query is reported as timed out.
+func (f *finder) queryClosest(target NodeID, candidates map[string]*lookupNode, query func() *Message) int {
+	c, _ := FromContext(f.ctx)
+	sorted := sortLookupNodes(target, candidates, INIT, QUESTIONABLE, GOOD)
+	inflight := 0
+	for _, ln := range sorted {
+		if ln.node.Status == QUESTIONABLE {
+			inflight++
+		}
+	}
+	for i := 0; i < len(sorted) && i < K && inflight < Alpha; i++ {
+		if sorted[i].node.Status == INIT {
+			m := query()
+			m.N = sorted[i].node
+			c.Outgoing <- m
+			sorted[i].node.Status = QUESTIONABLE
+			inflight++
+		}
+	}
+	return inflight
+}
+
+// lookup walks towards target with the queries built by query until the K
+// closest nodes have answered or failed. visit is called with every response
+// and returns nil for a message it does not expect. The responsive nodes are
+// returned closest first, followed by the nodes which replied with an error
+// or timed out.
+func (f *finder) lookup(name string, target NodeID, queriedNodes []Node, query func() *Message, visit func(msg *Message) *lookupReply) ([]TokenNode, []NodeError) {
+	c, _ := FromContext(f.ctx)
+	candidates := make(map[string]*lookupNode)
+	for i := range queriedNodes {
+		n := queriedNodes[i]
+		n.Status = INIT
+		candidates[n.Addr.String()] = &lookupNode{node: n}
+	}
+	var failed []NodeError
+	f.status.Store(Running)
+	begin := time.Now()
+
+	c.Log.Infof("%s(#%d): %s start", name, f.idx, target.HexString())
+loop:
+	for f.queryClosest(target, candidates, query) > 0 {
+		select {
+		case msg := <-f.Chan:
+			ln, ok := candidates[msg.N.Addr.String()]
+			if !ok || ln.node.Status != QUESTIONABLE {
+				break
+			}
+			if msg.Y == YTimeout {
+				ln.node.Status = BAD
+				failed = append(failed, NodeError{ln.node, msg.A.(TimeoutError)})
+				break
+			}
+			if msg.Y == "e" {
+				ln.node.Status = BAD
+				failed = append(failed, NodeError{ln.node, msg.A.(*Err)})
+				c.Log.Debugf("%s(#%d): %s from %s", name, f.idx, msg.A.(*Err), msg.N.Addr)
+				break
+			}
+			if msg.Y != "r" {
+				break
+			}
+			reply := visit(msg)
+			if reply == nil {
+				c.Log.WithFields(logrus.Fields{
+					"msg": msg,
+				}).Errorf("%s(#%d): Incorrect msg, got %s", name, f.idx, msg.Q)
+				break
+			}
+			ln.node.ID = msg.N.ID
+			ln.node.Status = GOOD
+			ln.token = reply.Token
+			c.Log.Debugf("%s(#%d): Got %d nodes from %s", name, f.idx, len(reply.Nodes), msg.N.Addr)
+			if reply.Stop {
+				break loop
+			}
+
+			for idx := range reply.Nodes {
+				n := reply.Nodes[idx]
+				if n.Port() <= 0 || net.IP(n.IP()).IsUnspecified() || bytes.Equal(n.ID, c.LocalID()) {
+					continue
+				}
+				if _, ok = candidates[n.Addr.String()]; !ok {
+					candidates[n.Addr.String()] = &lookupNode{node: n}
+				}
+			}
+
+		case <-time.After(time.Second):
+			if time.Now().Sub(begin).Seconds() >= FindNodeTimeLimit {
+				c.Log.Infof("%s(#%d) timeout, exceeds %d seconds", name, f.idx, FindNodeTimeLimit)
+				break loop
+			}
+
+		case <-f.ctx.Done():
+			c.Log.Errorf("%s(#%d) canceled, %s", name, f.idx, f.ctx.Err())
+			break loop
+		}
+	}
+	f.status.Store(Finished)
+
+	var ret []TokenNode
+	for _, ln := range sortLookupNodes(target, candidates, GOOD) {
+		ret = append(ret, TokenNode{ln.node, ln.token})
+	}
+	return ret, failed
+}
+
+// store sends the query built by query to every node at once and waits for
+// their acknowledgements, errors or RequestTimeout.
+func (f *finder) store(name string, nodes []TokenNode, query func(n *TokenNode) *Message) ([]Node, []NodeError) {
+	c, _ := FromContext(f.ctx)
+	var acked []Node
+	var failed []NodeError
+	pending := make(map[string]*TokenNode)
+	f.status.Store(Running)
+	for i := range nodes {
+		m := query(&nodes[i])
+		m.N = nodes[i].Node
+		c.Outgoing <- m
+		pending[nodes[i].Addr.String()] = &nodes[i]
+	}
+	begin := time.Now()
+
+	c.Log.Infof("%s(#%d): start, %d nodes", name, f.idx, len(nodes))
+loop:
+	for len(pending) > 0 {
+		select {
+		case msg := <-f.Chan:
+			n, ok := pending[msg.N.Addr.String()]
+			if !ok {
+				break
+			}
+			switch msg.Y {
+			case "r":
+				acked = append(acked, n.Node)
+			case "e":
+				failed = append(failed, NodeError{n.Node, msg.A.(*Err)})
+			case YTimeout:
+				failed = append(failed, NodeError{n.Node, msg.A.(TimeoutError)})
+			}
+			delete(pending, msg.N.Addr.String())
+
+		case <-time.After(time.Second):
+			if time.Now().Sub(begin).Seconds() >= RequestTimeout {
+				break loop
+			}
+
+		case <-f.ctx.Done():
+			c.Log.Errorf("%s(#%d) canceled, %s", name, f.idx, f.ctx.Err())
+			break loop
+		}
+	}
+	f.status.Store(Finished)
+
+	for _, n := range pending {
+		failed = append(failed, NodeError{n.Node, TimeoutError{name + " to " + n.Addr.String()}})
+	}
+	c.Log.Infof("%s(#%d) finished, %d acked, %d failed", name, f.idx, len(acked), len(failed))
+	return acked, failed
+}
+
+func (f *finder) getPeers(infoHash NodeID, queriedNodes []Node, stream chan<- *Peer) *GetPeersResult {
+	c, _ := FromContext(f.ctx)
+	result := &GetPeersResult{InfoHash: infoHash}
+	peers := make(map[string]bool)
+
+	query := func() *Message {
+		return KRPCNewGetPeers(c.LocalID(), infoHash, f.idx)
+	}
+	visit := func(msg *Message) *lookupReply {
+		response, ok := msg.A.(*GetPeersResponse)
+		if !ok {
+			return nil
+		}
+		for _, p := range response.Values {
+			if peers[p.String()] {
+				continue
+			}
+			peers[p.String()] = true
+			result.Peers = append(result.Peers, p)
+			if stream != nil {
+				select {
+				case stream <- p:
+				case <-f.ctx.Done():
+				}
+			}
+		}
+		return &lookupReply{Token: response.Token, Nodes: response.nodes(f.ipv6)}
+	}
+	result.Nodes, result.Failed = f.lookup("GetPeers", infoHash, queriedNodes, query, visit)
+	c.Log.Infof("GetPeers(#%d) finished, got %d peers, %d responsive nodes", f.idx, len(result.Peers), len(result.Nodes))
+	return result
+}
+
+// ScrapeResult is the BEP 33 swarm size estimate of an info hash.
+type ScrapeResult struct {
+	InfoHash NodeID
+	Seeds    int
+	// Downloaders
+	Peers int
+	// Nodes which returned bloom filters
+	Nodes int
+}
+
+// scrape runs a get_peers lookup with scrape=1 and returns the merged seed
+// and downloader filters and the number of nodes which contributed.
+func (f *finder) scrape(infoHash NodeID, queriedNodes []Node) (bloomFilter, bloomFilter, int) {
+	c, _ := FromContext(f.ctx)
+	bfsd := newBloomFilter()
+	bfpe := newBloomFilter()
+	n := 0
+
+	query := func() *Message {
+		m := KRPCNewGetPeers(c.LocalID(), infoHash, f.idx)
+		q := m.A.(*GetPeersQuery)
+		q.Scrape = true
+		q.NoSeed = true
+		return m
+	}
+	visit := func(msg *Message) *lookupReply {
+		response, ok := msg.A.(*GetPeersResponse)
+		if !ok {
+			return nil
+		}
+		if response.BFsd != nil || response.BFpe != nil {
+			bfsd.merge(response.BFsd)
+			bfpe.merge(response.BFpe)
+			n++
+		}
+		return &lookupReply{Token: response.Token, Nodes: response.nodes(f.ipv6)}
+	}
+	f.lookup("Scrape", infoHash, queriedNodes, query, visit)
+	c.Log.Infof("Scrape(#%d) finished, %d nodes, seeds %d, peers %d", f.idx, n, bfsd.estimate(), bfpe.estimate())
+	return bfsd, bfpe, n
+}
+
+func (f *finder) announcePeer(infoHash NodeID, port int, impliedPort bool, nodes []TokenNode) *AnnounceResult {
+	c, _ := FromContext(f.ctx)
+	result := &AnnounceResult{InfoHash: infoHash}
+	result.Acked, result.Failed = f.store("AnnouncePeer", nodes, func(n *TokenNode) *Message {
+		return KRPCNewAnnouncePeer(c.LocalID(), infoHash.String(), port, n.Token, impliedPort, f.idx)
+	})
+	return result
+}
+
+// GetItemResult is the outcome of an iterative BEP 44 get lookup.
+type GetItemResult struct {
+	Target NodeID
+	// nil if no node returned a valid item
+	Item *Item
+	// Responsive nodes, closest to Target first
+	Nodes []TokenNode
+	// Nodes which replied with a KRPC error or timed out
+	Failed []NodeError
+}
+
+// PutResult is the outcome of a BEP 44 put round.
+type PutResult struct {
+	Target NodeID
+	Acked  []Node
+	Failed []NodeError
+}
+
+// getItem looks up target, for a mutable target salt is needed to verify the
+// returned items and the one with the highest seq wins. An immutable lookup
+// stops at the first valid item unless all is set.
+func (f *finder) getItem(target NodeID, salt []byte, mutable bool, all bool, queriedNodes []Node) *GetItemResult {
+	c, _ := FromContext(f.ctx)
+	result := &GetItemResult{Target: target}
+
+	query := func() *Message {
+		var seq *int64
+		if result.Item != nil && mutable {
+			seq = &result.Item.Seq
+		}
+		return KRPCNewGet(c.LocalID(), target, seq, f.idx)
+	}
+	visit := func(msg *Message) *lookupReply {
+		response, ok := msg.A.(*GetResponse)
+		if !ok {
+			return nil
+		}
+		reply := &lookupReply{Token: response.Token, Nodes: response.nodes(f.ipv6)}
+		item := response.Item
+		if item == nil || item.Mutable() != mutable {
+			return reply
+		}
+		item.Salt = salt
+		if !bytes.Equal(item.Target(), target) || !item.Verify() {
+			c.Log.Warnf("GetItem(#%d): Invalid item from %s", f.idx, msg.N.Addr)
+			return reply
+		}
+		if result.Item == nil || item.Seq > result.Item.Seq {
+			result.Item = item
+		}
+		reply.Stop = !mutable && !all
+		return reply
+	}
+	result.Nodes, result.Failed = f.lookup("GetItem", target, queriedNodes, query, visit)
+	c.Log.Infof("GetItem(#%d) finished, found %t, %d responsive nodes", f.idx, result.Item != nil, len(result.Nodes))
+	return result
+}
+
+func (f *finder) putItem(item *Item, cas *int64, nodes []TokenNode) *PutResult {
+	c, _ := FromContext(f.ctx)
+	result := &PutResult{Target: item.Target()}
+	result.Acked, result.Failed = f.store("PutItem", nodes, func(n *TokenNode) *Message {
+		return KRPCNewPut(c.LocalID(), n.Token, item, cas, f.idx)
+	})
+	return result
+}
+
+// sampleInfoHashes walks towards target with BEP 51 sample_infohashes
+// queries and calls emit with every sample received. Nodes in skip are not
+// queried until the time recorded there, every responsive node is added with
+// the interval it asked for.
+func (f *finder) sampleInfoHashes(target NodeID, queriedNodes []Node, skip map[string]time.Time, emit func(NodeID)) []TokenNode {
+	c, _ := FromContext(f.ctx)
+	now := time.Now()
+	allowed := func(nodes []Node) []Node {
+		var ret []Node
+		for _, n := range nodes {
+			if now.Before(skip[n.Addr.String()]) {
+				continue
+			}
+			ret = append(ret, n)
+		}
+		return ret
+	}
+	samples := 0
+
+	query := func() *Message {
+		return KRPCNewSampleInfoHashes(c.LocalID(), target, f.idx)
+	}
+	visit := func(msg *Message) *lookupReply {
+		response, ok := msg.A.(*SampleInfoHashesResponse)
+		if !ok {
+			return nil
+		}
+		skip[msg.N.Addr.String()] = time.Now().Add(time.Duration(response.Interval) * time.Second)
+		for _, s := range response.Samples {
+			emit(s)
+		}
+		samples += len(response.Samples)
+		return &lookupReply{Nodes: allowed(response.nodes(f.ipv6))}
+	}
+	nodes, _ := f.lookup("SampleInfoHashes", target, allowed(queriedNodes), query, visit)
+	c.Log.Infof("SampleInfoHashes(#%d) finished, got %d samples from %d nodes", f.idx, samples, len(nodes))
+	return nodes
+}
@@ -0,0 +1,58 @@
+package kademila
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLookupFailures(t *testing.T) {
+	ctx := testContext(t, nil)
+	c, _ := FromContext(ctx)
+	tb := newTable(ctx, false)
+	f, cancel := tb.newLookup(ctx)
+	defer cancel()
+	defer tb.releaseLookup(f)
+
+	erring, silent := testNode(1, true), testNode(2, true)
+	// Responses nobody waits for fill the queue of the lookup
+	for i := 0; i < FinderQueueSize; i++ {
+		stale := testNode(100+i, true)
+		tb.forward(&Message{Y: "r", Q: "find_node", W: f.idx, N: *stale, A: &FindNodeResponse{ID: stale.ID.String()}})
+	}
+	forwarded := make(chan bool)
+	go func() {
+		defer close(forwarded)
+		tb.forward(&Message{Y: "e", Q: "find_node", W: f.idx, N: *erring, A: &Err{GenericError, ErrorDefinitions[GenericError]}})
+		tb.forward(&Message{Y: YTimeout, Q: "find_node", W: f.idx, N: *silent, A: TimeoutError{"find_node to " + silent.Addr.String()}})
+	}()
+	// They wait for room rather than being dropped
+	select {
+	case <-forwarded:
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	query := func() *Message { return KRPCNewFindNode(c.LocalID(), GenerateID(), f.idx) }
+	visit := func(msg *Message) *lookupReply { return nil }
+	done := make(chan []NodeError)
+	go func() {
+		_, failed := f.lookup("FindNode", GenerateID(), []Node{*erring, *silent}, query, visit)
+		done <- failed
+	}()
+	var failed []NodeError
+	select {
+	case failed = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lookup still waiting for its failed nodes")
+	}
+
+	errs := map[string]error{}
+	for _, ne := range failed {
+		errs[ne.Node.Addr.String()] = ne.Err
+	}
+	if _, ok := errs[erring.Addr.String()].(*Err); !ok {
+		t.Errorf("error reply recorded as %v", errs[erring.Addr.String()])
+	}
+	if _, ok := errs[silent.Addr.String()].(TimeoutError); !ok {
+		t.Errorf("timeout recorded as %v", errs[silent.Addr.String()])
+	}
+}
@@ -1,12 +1,15 @@
 package kademila
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"math/big"
 	"math/rand"
 	"net"
+	"sort"
 	"strconv"
 	"time"
 )
@@ -17,10 +20,67 @@ func GenerateID() NodeID {
 	random := rand.New(rand.NewSource(time.Now().UnixNano()))
 	hash := sha1.New()
 	io.WriteString(hash, time.Now().String())
-	io.WriteString(hash, string(random.Int()))
+	io.WriteString(hash, strconv.Itoa(random.Int()))
 	return hash.Sum(nil)
 }
 
+var (
+	castagnoli  = crc32.MakeTable(crc32.Castagnoli)
+	secureMask4 = []byte{0x03, 0x0f, 0x3f, 0xff}
+	secureMask6 = []byte{0x01, 0x03, 0x07, 0x0f, 0x1f, 0x3f, 0x7f, 0xff}
+)
+
+// secureCRC returns the CRC32-C of the masked ip with the 3 bits r mixed in
+// (BEP 42).
+func secureCRC(ip net.IP, r byte) uint32 {
+	var masked []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		masked = make([]byte, len(secureMask4))
+		for i := range masked {
+			masked[i] = ip4[i] & secureMask4[i]
+		}
+	} else {
+		masked = make([]byte, len(secureMask6))
+		for i := range masked {
+			masked[i] = ip[i] & secureMask6[i]
+		}
+	}
+	masked[0] |= (r & 0x7) << 5
+	return crc32.Checksum(masked, castagnoli)
+}
+
+// exemptIP reports whether ip is a local address, which BEP 42 does not
+// apply to.
+func exemptIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast()
+}
+
+// GenerateSecureID returns a random node ID which is valid for the external
+// ip according to BEP 42.
+func GenerateSecureID(ip net.IP) NodeID {
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+	id := make([]byte, 20)
+	random.Read(id)
+	crc := secureCRC(ip, id[19])
+	id[0] = byte(crc >> 24)
+	id[1] = byte(crc >> 16)
+	id[2] = byte(crc>>8)&0xf8 | id[2]&0x7
+	return id
+}
+
+// VerifyID checks that the first 21 bits of id match the external ip
+// according to BEP 42. Local addresses are always valid.
+func VerifyID(id NodeID, ip net.IP) bool {
+	if len(id) != 20 || len(ip) == 0 {
+		return false
+	}
+	if exemptIP(ip) {
+		return true
+	}
+	crc := secureCRC(ip, id[19])
+	return id[0] == byte(crc>>24) && id[1] == byte(crc>>16) && id[2]&0xf8 == byte(crc>>8)&0xf8
+}
+
 func (id NodeID) String() string {
 	return string(id)
 }
@@ -65,18 +125,59 @@ func (id NodeID) Distance(dst NodeID) int {
 	return Distance(id, dst)
 }
 
+// Distance returns the bit length of the XOR distance between src and dst,
+// the number of the bits after their common prefix.
 func Distance(src, dst NodeID) int {
-	var d int
-	for i := 0; i < len(src); i++ {
-		b := src[i] ^ dst[i]
-		if b == 0 {
-			d += 8
+	return XOR(src, dst).BitLen()
+}
+
+// XORDistance is the 160-bit Kademlia distance between two IDs.
+type XORDistance [20]byte
+
+// XOR returns the distance between a and b, missing bytes count as zero.
+func XOR(a, b NodeID) XORDistance {
+	var d XORDistance
+	for i := range d {
+		var x, y byte
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		d[i] = x ^ y
+	}
+	return d
+}
+
+// Cmp returns -1, 0 or 1 if d is closer than, as close as or farther than o.
+func (d XORDistance) Cmp(o XORDistance) int {
+	return bytes.Compare(d[:], o[:])
+}
+
+// BitLen returns the number of the bits after the leading zeros.
+func (d XORDistance) BitLen() int {
+	n := 0
+	for i := range d {
+		if d[i] == 0 {
+			n += 8
 		} else {
-			d += BitsInByte(b)
+			n += BitsInByte(d[i])
 			break
 		}
 	}
-	return MaxBitsLength - d
+	return MaxBitsLength - n
+}
+
+func (d XORDistance) String() string {
+	return fmt.Sprintf("%x", d[:])
+}
+
+// SortByDistance sorts nodes from the closest to target to the farthest.
+func SortByDistance(target NodeID, nodes []Node) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return XOR(target, nodes[i].ID).Cmp(XOR(target, nodes[j].ID)) < 0
+	})
 }
 
 type Node struct {
@@ -84,6 +185,11 @@ type Node struct {
 	Addr     net.Addr
 	Status   uint8
 	LastSeen time.Time
+	// When the node last answered one of our queries and last queried us
+	LastResponse time.Time
+	LastQuery    time.Time
+	// Our queries it left unanswered since its last response
+	Failures int
 }
 
 func (node Node) IP() []byte {
@@ -94,6 +200,10 @@ func (node Node) Port() int {
 	return node.Addr.(*net.UDPAddr).Port
 }
 
+func (node Node) IsIPv6() bool {
+	return net.IP(node.IP()).To4() == nil
+}
+
 func (node Node) SStatus() string {
 	return statusNames[node.Status]
 }
@@ -105,11 +215,50 @@ func (node Node) String() string {
 	return fmt.Sprintf("ID=%s, Addr=, Status=%d", node.ID.HexString(), node.Status)
 }
 
+// Clone returns a copy of node which shares nothing with it, its address
+// included.
 func (node *Node) Clone() *Node {
 	n := new(Node)
+	*n = *node
 	n.ID = make([]byte, len(node.ID))
 	copy(n.ID, node.ID)
-	n.Addr = node.Addr
-	n.Status = node.Status
+	if a, ok := node.Addr.(*net.UDPAddr); ok && a != nil {
+		addr := *a
+		addr.IP = make(net.IP, len(a.IP))
+		copy(addr.IP, a.IP)
+		n.Addr = &addr
+	}
 	return n
 }
+
+// updateStatus applies the rules of BEP 5. A node is good if it answered us
+// within NodeQuestionableTimeLimit, or ever answered and queried us within
+// it. It is bad once MaxNodeFailures queries in a row went unanswered, and
+// questionable otherwise.
+func (node *Node) updateStatus(now time.Time) {
+	limit := NodeQuestionableTimeLimit * time.Minute
+	switch {
+	case node.Failures >= MaxNodeFailures:
+		node.Status = BAD
+	case now.Sub(node.LastResponse) < limit:
+		node.Status = GOOD
+	case !node.LastResponse.IsZero() && now.Sub(node.LastQuery) < limit:
+		node.Status = GOOD
+	default:
+		node.Status = QUESTIONABLE
+	}
+}
+
+// merge records what we learned about the node from n.
+func (node *Node) merge(n *Node) {
+	if n.LastResponse.After(node.LastResponse) {
+		node.LastResponse = n.LastResponse
+		node.Failures = 0
+	}
+	if n.LastQuery.After(node.LastQuery) {
+		node.LastQuery = n.LastQuery
+	}
+	if n.Addr != nil {
+		node.Addr = n.Addr
+	}
+}
@@ -0,0 +1,69 @@
+package kademila
+
+import (
+	"net"
+	"testing"
+)
+
+// Test vectors of BEP 42
+var secureIDVectors = []struct {
+	ip     string
+	random byte
+	id     string
+}{
+	{"124.31.75.21", 1, "5fbfbff10c5d6a4ec8a88e4c6ab4c28b95eee401"},
+	{"21.75.31.124", 86, "5a3ce9c14e7a08645677bbd1cfe7d8f956d53256"},
+	{"65.23.51.170", 22, "a5d43220bc8f112a3d426c84764f8c2a1150e616"},
+	{"84.124.73.14", 65, "1b0321dd1bb1fe518101ceef99462b947a01ff41"},
+	{"43.213.53.83", 90, "e56f6cbf5b7c4be0237986d5243b87aa6d51305a"},
+}
+
+func TestVerifyID(t *testing.T) {
+	for _, v := range secureIDVectors {
+		ip := net.ParseIP(v.ip)
+		id := HexToID(v.id)
+		if id[19] != v.random {
+			t.Fatalf("%s: last byte is %d, want %d", v.ip, id[19], v.random)
+		}
+		if !VerifyID(id, ip) {
+			t.Errorf("%s: %s not valid", v.ip, v.id)
+		}
+		// Any change in the first 21 bits makes it invalid
+		id[2] ^= 0x08
+		if VerifyID(id, ip) {
+			t.Errorf("%s: altered %x still valid", v.ip, id)
+		}
+	}
+}
+
+func TestVerifyIDExempt(t *testing.T) {
+	id := HexToID(secureIDVectors[0].id)
+	for _, ip := range []string{"127.0.0.1", "10.0.0.1", "192.168.1.1"} {
+		if !VerifyID(id, net.ParseIP(ip)) {
+			t.Errorf("%s: local address not exempt", ip)
+		}
+	}
+	if VerifyID(id[:19], net.ParseIP(secureIDVectors[0].ip)) {
+		t.Error("short ID valid")
+	}
+}
+
+func TestGenerateSecureID(t *testing.T) {
+	ips := []string{"2001:db8::1"}
+	for _, v := range secureIDVectors {
+		ips = append(ips, v.ip)
+	}
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		id := GenerateSecureID(ip)
+		if len(id) != 20 {
+			t.Fatalf("%s: ID of %d bytes", s, len(id))
+		}
+		if !VerifyID(id, ip) {
+			t.Errorf("%s: generated %x not valid", s, id)
+		}
+	}
+	if VerifyID(GenerateSecureID(net.ParseIP("1.2.3.4")), net.ParseIP("5.6.7.8")) {
+		t.Error("ID of 1.2.3.4 valid for 5.6.7.8")
+	}
+}
@@ -0,0 +1,54 @@
+package kademila
+
+// Options are the settings of one node, start from DefaultOptions.
+type Options struct {
+	// BEP 20 client identifier sent as `v` in every message, empty to leave
+	// it out
+	ClientVersion string
+	// BEP 43, query the DHT without answering queries or joining routing
+	// tables
+	ReadOnly bool
+	// BEP 42 node ID policy of the routing table, SecureIDIgnore,
+	// SecureIDPrefer or SecureIDRequire
+	SecureIDPolicy int
+	// Sybil resistance, the nodes allowed per IP and per /24 (/64 for IPv6)
+	// subnet in a bucket and in the whole table, 0 for no limit. Local
+	// addresses are not limited.
+	MaxNodesPerIP             int
+	MaxNodesPerSubnetInBucket int
+	MaxNodesPerSubnet         int
+	// Relaxed bucket splitting, like libtorrent's extended routing table.
+	// The size of the buckets by the number of leading bits their IDs share
+	// with ours, e.g. []int{128, 64, 32, 16}, the other buckets hold K
+	// nodes.
+	BucketSizes []int
+	// Nodes in a routing table, 0 for no limit
+	MaxTableSize int
+	// File keeping our node ID across runs, empty to generate a new one each
+	// time
+	IdentityPath string
+	// Where the node ID and routing tables are saved, empty to disable
+	SnapshotPath string
+}
+
+// DefaultOptions returns the options used when none are given.
+func DefaultOptions() *Options {
+	return &Options{
+		ClientVersion:             clientVersion(APPNAME, VERSION),
+		SecureIDPolicy:            SecureIDIgnore,
+		MaxNodesPerIP:             1,
+		MaxNodesPerSubnetInBucket: 2,
+		MaxNodesPerSubnet:         10,
+	}
+}
+
+// copyOptions returns a copy of opts the caller can't change any more, the
+// defaults if opts is nil.
+func copyOptions(opts *Options) *Options {
+	if opts == nil {
+		return DefaultOptions()
+	}
+	o := *opts
+	o.BucketSizes = append([]int(nil), opts.BucketSizes...)
+	return &o
+}
@@ -3,6 +3,7 @@ package kademila
 import (
 	"fmt"
 	"net"
+	"strconv"
 )
 
 type Peer struct {
@@ -11,5 +12,9 @@ type Peer struct {
 }
 
 func (peer Peer) String() string {
-	return fmt.Sprintf("Addr=%s:%d", peer.IP.String(), peer.Port)
+	return fmt.Sprintf("Addr=%s", net.JoinHostPort(peer.IP.String(), strconv.Itoa(peer.Port)))
+}
+
+func (peer Peer) IsIPv6() bool {
+	return peer.IP.To4() == nil
 }
@@ -0,0 +1,200 @@
+package kademila
+
+import (
+	"container/list"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Rough memory cost of the entries, used against MaxPeerStoreSize
+const (
+	swarmSize      = 128
+	storedPeerSize = 64
+)
+
+type storedPeer struct {
+	peer      *Peer
+	seed      bool
+	announced time.Time
+}
+
+type swarm struct {
+	infoHash string
+	peers    map[string]*storedPeer
+}
+
+func (sw *swarm) size() int {
+	return swarmSize + len(sw.peers)*storedPeerSize
+}
+
+// oldest returns the key of the peer announced longest ago.
+func (sw *swarm) oldest() string {
+	var key string
+	var t time.Time
+	for k, p := range sw.peers {
+		if key == "" || p.announced.Before(t) {
+			key = k
+			t = p.announced
+		}
+	}
+	return key
+}
+
+// peerStore keeps the peers announced to us, keyed by info hash. Swarms are
+// ordered by last use and the least recently used one is evicted first.
+type peerStore struct {
+	lock       *sync.Mutex
+	swarms     map[string]*list.Element
+	lru        *list.List
+	size       int
+	lastExpire time.Time
+}
+
+func newPeerStore() *peerStore {
+	s := new(peerStore)
+	s.lock = new(sync.Mutex)
+	s.swarms = make(map[string]*list.Element)
+	s.lru = list.New()
+	s.lastExpire = time.Now()
+	return s
+}
+
+func (s *peerStore) add(infoHash string, peer *Peer, seed bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var sw *swarm
+	e, ok := s.swarms[infoHash]
+	if ok {
+		s.lru.MoveToFront(e)
+		sw = e.Value.(*swarm)
+	} else {
+		sw = &swarm{infoHash, make(map[string]*storedPeer)}
+		s.swarms[infoHash] = s.lru.PushFront(sw)
+		s.size += swarmSize
+	}
+
+	key := peer.String()
+	p, ok := sw.peers[key]
+	if ok {
+		p.seed = seed
+		p.announced = time.Now()
+		return
+	}
+	if len(sw.peers) >= MaxPeersPerInfoHash {
+		delete(sw.peers, sw.oldest())
+		s.size -= storedPeerSize
+	}
+	ip := make([]byte, len(peer.IP))
+	copy(ip, peer.IP)
+	sw.peers[key] = &storedPeer{&Peer{Port: peer.Port, IP: ip}, seed, time.Now()}
+	s.size += storedPeerSize
+
+	for s.lru.Len() > 1 && (s.lru.Len() > MaxInfoHashes || s.size > MaxPeerStoreSize) {
+		s.remove(s.lru.Back())
+	}
+}
+
+// get returns at most max peers of infoHash of the given address family, a
+// random subset if there are more. With noseed the seeds are left out.
+func (s *peerStore) get(infoHash string, max int, ipv6 bool, noseed bool) []*Peer {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	e, ok := s.swarms[infoHash]
+	if !ok {
+		return nil
+	}
+	s.lru.MoveToFront(e)
+	sw := e.Value.(*swarm)
+	ret := make([]*Peer, 0, len(sw.peers))
+	for _, p := range sw.peers {
+		if p.peer.IsIPv6() == ipv6 && !(noseed && p.seed) {
+			ret = append(ret, p.peer)
+		}
+	}
+	if len(ret) > max {
+		rand.Shuffle(len(ret), func(i, j int) { ret[i], ret[j] = ret[j], ret[i] })
+		ret = ret[:max]
+	}
+	return ret
+}
+
+// scrape returns the BEP 33 bloom filters of the seeds and the downloaders
+// of infoHash.
+func (s *peerStore) scrape(infoHash string) (bloomFilter, bloomFilter) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	bfsd := newBloomFilter()
+	bfpe := newBloomFilter()
+	e, ok := s.swarms[infoHash]
+	if !ok {
+		return bfsd, bfpe
+	}
+	for _, p := range e.Value.(*swarm).peers {
+		if p.seed {
+			bfsd.add(p.peer.IP)
+		} else {
+			bfpe.add(p.peer.IP)
+		}
+	}
+	return bfsd, bfpe
+}
+
+// sample returns at most max random info hashes of the store (BEP 51).
+func (s *peerStore) sample(max int) []NodeID {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ret := make([]NodeID, 0, max)
+	i := 0
+	for infoHash := range s.swarms {
+		if len(ret) < max {
+			ret = append(ret, NodeID(infoHash))
+		} else if j := rand.Intn(i + 1); j < max {
+			ret[j] = NodeID(infoHash)
+		}
+		i++
+	}
+	return ret
+}
+
+func (s *peerStore) remove(e *list.Element) {
+	sw := s.lru.Remove(e).(*swarm)
+	delete(s.swarms, sw.infoHash)
+	s.size -= sw.size()
+}
+
+// expire drops the peers which have not announced again for PeerTimeLimit.
+func (s *peerStore) expire() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastExpire).Seconds() < PeerExpireInterval {
+		return
+	}
+	s.lastExpire = now
+	for e := s.lru.Front(); e != nil; {
+		next := e.Next()
+		sw := e.Value.(*swarm)
+		for k, p := range sw.peers {
+			if now.Sub(p.announced).Minutes() >= PeerTimeLimit {
+				delete(sw.peers, k)
+				s.size -= storedPeerSize
+			}
+		}
+		if len(sw.peers) == 0 {
+			s.remove(e)
+		}
+		e = next
+	}
+}
+
+func (s *peerStore) len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.lru.Len()
+}
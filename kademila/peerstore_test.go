@@ -0,0 +1,115 @@
+package kademila
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testPeer(i int) *Peer {
+	return &Peer{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)).To4(), Port: 6881}
+}
+
+// checkPeerStoreSize compares the size accounted by s with its content.
+func checkPeerStoreSize(t *testing.T, name string, s *peerStore) {
+	size := 0
+	for e := s.lru.Front(); e != nil; e = e.Next() {
+		size += e.Value.(*swarm).size()
+	}
+	if s.size != size || len(s.swarms) != s.lru.Len() {
+		t.Errorf("%s: size %d of %d swarms, want %d of %d", name, s.size, len(s.swarms), size, s.lru.Len())
+	}
+}
+
+func TestPeerStoreGet(t *testing.T) {
+	s := newPeerStore()
+	infoHash := string(GenerateID())
+	s.add(infoHash, testPeer(1), false)
+	s.add(infoHash, testPeer(2), true)
+	s.add(infoHash, &Peer{IP: net.ParseIP("2001:db8::1"), Port: 6881}, false)
+	// Announcing again only refreshes the peer
+	s.add(infoHash, testPeer(1), false)
+
+	tests := []struct {
+		name   string
+		max    int
+		ipv6   bool
+		noseed bool
+		want   int
+	}{
+		{"IPv4", 10, false, false, 2},
+		{"IPv6", 10, true, false, 1},
+		{"no seeds", 10, false, true, 1},
+		{"at most max", 1, false, false, 1},
+	}
+	for _, test := range tests {
+		if peers := s.get(infoHash, test.max, test.ipv6, test.noseed); len(peers) != test.want {
+			t.Errorf("%s: %d peers, want %d", test.name, len(peers), test.want)
+		}
+	}
+	if peers := s.get(string(GenerateID()), 10, false, false); peers != nil {
+		t.Errorf("%d peers of an unknown info hash", len(peers))
+	}
+	checkPeerStoreSize(t, "get", s)
+}
+
+func TestPeerStoreLimits(t *testing.T) {
+	s := newPeerStore()
+	infoHash := string(GenerateID())
+	s.add(infoHash, testPeer(0), false)
+	sw := s.swarms[infoHash].Value.(*swarm)
+	sw.peers[testPeer(0).String()].announced = time.Now().Add(-time.Minute)
+	for i := 1; i <= MaxPeersPerInfoHash; i++ {
+		s.add(infoHash, testPeer(i), false)
+	}
+	if len(sw.peers) != MaxPeersPerInfoHash {
+		t.Errorf("%d peers, want %d", len(sw.peers), MaxPeersPerInfoHash)
+	}
+	if _, ok := sw.peers[testPeer(0).String()]; ok {
+		t.Error("oldest peer not dropped")
+	}
+	checkPeerStoreSize(t, "peers", s)
+
+	// The least recently used swarm goes first
+	for i := 1; i < MaxInfoHashes; i++ {
+		s.add(strconv.Itoa(i), testPeer(i), false)
+	}
+	s.get(infoHash, 1, false, false)
+	s.add("last", testPeer(0), false)
+	if s.len() != MaxInfoHashes {
+		t.Errorf("%d info hashes, want %d", s.len(), MaxInfoHashes)
+	}
+	if _, ok := s.swarms["1"]; ok {
+		t.Error("least recently used swarm kept")
+	}
+	if _, ok := s.swarms[infoHash]; !ok {
+		t.Error("recently used swarm dropped")
+	}
+	checkPeerStoreSize(t, "swarms", s)
+}
+
+func TestPeerStoreExpire(t *testing.T) {
+	s := newPeerStore()
+	old, fresh := string(GenerateID()), string(GenerateID())
+	s.add(old, testPeer(1), false)
+	s.add(fresh, testPeer(1), false)
+	s.add(fresh, testPeer(2), false)
+	stale := time.Now().Add(-PeerTimeLimit * time.Minute)
+	s.swarms[old].Value.(*swarm).peers[testPeer(1).String()].announced = stale
+	s.swarms[fresh].Value.(*swarm).peers[testPeer(1).String()].announced = stale
+
+	s.expire()
+	if s.len() != 2 {
+		t.Fatalf("expired before PeerExpireInterval")
+	}
+	s.lastExpire = time.Now().Add(-PeerExpireInterval * time.Second)
+	s.expire()
+	if _, ok := s.swarms[old]; ok || s.len() != 1 {
+		t.Errorf("swarm without peers kept")
+	}
+	if peers := s.get(fresh, 10, false, false); len(peers) != 1 || peers[0].String() != testPeer(2).String() {
+		t.Errorf("got %v, want %v", peers, testPeer(2))
+	}
+	checkPeerStoreSize(t, "expire", s)
+}
@@ -0,0 +1,207 @@
+package kademila
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+// SnapshotVersion is the version of the snapshot format, snapshots of other
+// versions are rejected.
+const SnapshotVersion = 1
+
+// The snapshot is a bencoded dictionary, times are in unix seconds and
+// addresses in the compact format of the KRPC `ip` field.
+type snapshot struct {
+	Version  int64            `bencode:"version"`
+	ID       string           `bencode:"id"`
+	Time     int64            `bencode:"time"`
+	Buckets  []bucketSnapshot `bencode:"buckets"`
+	Buckets6 []bucketSnapshot `bencode:"buckets6"`
+}
+
+type bucketSnapshot struct {
+	Min         string         `bencode:"min"`
+	Max         string         `bencode:"max"`
+	LastUpdated int64          `bencode:"changed"`
+	Nodes       []nodeSnapshot `bencode:"nodes"`
+}
+
+type nodeSnapshot struct {
+	ID           string `bencode:"id"`
+	Addr         string `bencode:"addr"`
+	Status       int64  `bencode:"status"`
+	LastSeen     int64  `bencode:"seen"`
+	LastResponse int64  `bencode:"response"`
+	LastQuery    int64  `bencode:"query"`
+	Failures     int64  `bencode:"failures"`
+}
+
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func fromUnixTime(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+func (t *table) snapshot() []bucketSnapshot {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	ret := make([]bucketSnapshot, 0, len(t.buckets))
+	for _, b := range t.buckets {
+		bs := bucketSnapshot{
+			Min:         string(b.min.Bytes()),
+			Max:         string(b.max.Bytes()),
+			LastUpdated: unixTime(b.lastUpdated),
+			Nodes:       make([]nodeSnapshot, 0, b.len()),
+		}
+		for _, n := range b.nodes {
+			buf := bytes.NewBuffer(nil)
+			convertIPPort(buf, n.IP(), n.Port())
+			bs.Nodes = append(bs.Nodes, nodeSnapshot{
+				ID:           n.ID.String(),
+				Addr:         buf.String(),
+				Status:       int64(n.Status),
+				LastSeen:     unixTime(n.LastSeen),
+				LastResponse: unixTime(n.LastResponse),
+				LastQuery:    unixTime(n.LastQuery),
+				Failures:     int64(n.Failures),
+			})
+		}
+		ret = append(ret, bs)
+	}
+	return ret
+}
+
+// snapshotNodes returns the nodes saved in buckets, skipping the malformed
+// ones.
+func snapshotNodes(buckets []bucketSnapshot) []Node {
+	var nodes []Node
+	for _, bs := range buckets {
+		for _, ns := range bs.Nodes {
+			addr, err := parseCompactAddr(ns.Addr)
+			if err != nil || len(ns.ID) != 20 {
+				continue
+			}
+			nodes = append(nodes, Node{
+				ID:           NodeID(ns.ID),
+				Addr:         addr,
+				Status:       uint8(ns.Status),
+				LastSeen:     fromUnixTime(ns.LastSeen),
+				LastResponse: fromUnixTime(ns.LastResponse),
+				LastQuery:    fromUnixTime(ns.LastQuery),
+				Failures:     int(ns.Failures),
+			})
+		}
+	}
+	return nodes
+}
+
+// Snapshot serializes the node ID and the routing tables.
+func (k *Kademila) Snapshot() ([]byte, error) {
+	c, _ := FromContext(k.ctx)
+	s := snapshot{
+		Version: SnapshotVersion,
+		ID:      c.LocalID().String(),
+		Time:    time.Now().Unix(),
+		Buckets: k.routing.snapshot(),
+	}
+	if k.routing6 != nil {
+		s.Buckets6 = k.routing6.snapshot()
+	}
+	return bencode.EncodeBytes(s)
+}
+
+func decodeSnapshot(data []byte) (*snapshot, error) {
+	s := new(snapshot)
+	if err := bencode.DecodeBytes(data, s); err != nil {
+		return nil, err
+	}
+	if s.Version != SnapshotVersion {
+		return nil, &DecodeError{"Snapshot error: unsupported version " + strconv.FormatInt(s.Version, 10)}
+	}
+	if len(s.ID) != 20 {
+		return nil, &DecodeError{"Snapshot error: invalid node ID"}
+	}
+	return s, nil
+}
+
+// saveSnapshot writes the snapshot to Options.SnapshotPath.
+func (k *Kademila) saveSnapshot() error {
+	c, _ := FromContext(k.ctx)
+	k.saveLock.Lock()
+	defer k.saveLock.Unlock()
+	k.lastSnapshot = time.Now()
+	data, err := k.Snapshot()
+	if err != nil {
+		return err
+	}
+	if err = writeFile(c.Options.SnapshotPath, data); err != nil {
+		return err
+	}
+	c.Log.Debugf("Snapshot saved to %s, %d bytes", c.Options.SnapshotPath, len(data))
+	return nil
+}
+
+// writeFile replaces the content of path with data, readers see either the
+// old or the new content, never a part of it.
+func writeFile(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// restore pings the nodes of a snapshot and adds those which answer, then
+// looks up our own ID from them to fill the table.
+func (t *table) restore(nodes []Node) {
+	c, _ := FromContext(t.ctx)
+	if len(nodes) == 0 {
+		t.bootstrap(c.LocalID())
+		return
+	}
+	f, cancel := t.newLookup(t.ctx)
+	defer cancel()
+	defer t.releaseLookup(f)
+	nodes = f.pingNodes(nodes)
+	good := 0
+	for i := range nodes {
+		if nodes[i].Status == GOOD {
+			good++
+			nodes[i].Failures = 0
+			t.addNode(&nodes[i])
+		}
+	}
+	c.Log.Infof("Restored %d of %d saved nodes, table size: %d", good, len(nodes), t.len())
+
+	t.finderLock.Lock()
+	defer t.finderLock.Unlock()
+	if finder := t.getFinder(); finder != nil {
+		t.goFindNodes(finder, c.LocalID(), lookupNodes(t, c.LocalID()))
+	}
+}
@@ -0,0 +1,184 @@
+package kademila
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	ctx := testContext(t, nil)
+	c, _ := FromContext(ctx)
+	k := &Kademila{ctx: ctx, routing: newTable(ctx, false), routing6: newTable(ctx, true)}
+	for i := 0; i < 100; i++ {
+		k.routing.addNode(testNode(i, i%2 == 0))
+		n := testNode(i, true)
+		n.Addr = &net.UDPAddr{IP: net.ParseIP("fd00::1").To16(), Port: 1000 + i}
+		n.ID = GenerateID()
+		n.LastQuery = time.Now().Add(-time.Hour)
+		k.routing6.addNode(n)
+	}
+
+	data, err := k.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := decodeSnapshot(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if NodeID(s.ID).String() != c.LocalID().String() {
+		t.Errorf("ID %x, want %x", s.ID, c.LocalID())
+	}
+	tests := []struct {
+		name    string
+		tb      *table
+		buckets []bucketSnapshot
+	}{
+		{"IPv4", k.routing, s.Buckets},
+		{"IPv6", k.routing6, s.Buckets6},
+	}
+	for _, test := range tests {
+		if len(test.buckets) != len(test.tb.buckets) {
+			t.Errorf("%s: %d buckets, want %d", test.name, len(test.buckets), len(test.tb.buckets))
+		}
+		saved := make(map[string]Node)
+		for _, n := range snapshotNodes(test.buckets) {
+			saved[n.ID.String()] = n
+		}
+		if len(saved) != test.tb.len() {
+			t.Errorf("%s: %d nodes, want %d", test.name, len(saved), test.tb.len())
+		}
+		for _, b := range test.tb.buckets {
+			for _, n := range b.nodes {
+				got, ok := saved[n.ID.String()]
+				if !ok {
+					t.Errorf("%s: %x not saved", test.name, n.ID)
+					continue
+				}
+				if got.Addr.String() != n.Addr.String() || got.Status != n.Status || got.Failures != n.Failures ||
+					unixTime(got.LastSeen) != unixTime(n.LastSeen) ||
+					unixTime(got.LastResponse) != unixTime(n.LastResponse) ||
+					unixTime(got.LastQuery) != unixTime(n.LastQuery) {
+					t.Errorf("%s: saved %v, want %v", test.name, got, n)
+				}
+			}
+		}
+	}
+}
+
+func TestSnapshotErrors(t *testing.T) {
+	valid := snapshot{Version: SnapshotVersion, ID: string(GenerateID())}
+	tests := []struct {
+		name string
+		s    func(s snapshot) snapshot
+	}{
+		{"other version", func(s snapshot) snapshot { s.Version++; return s }},
+		{"short ID", func(s snapshot) snapshot { s.ID = s.ID[:19]; return s }},
+	}
+	for _, test := range tests {
+		data, _ := bencode.EncodeBytes(test.s(valid))
+		if _, err := decodeSnapshot(data); err == nil {
+			t.Errorf("%s: decoded", test.name)
+		}
+	}
+	if _, err := decodeSnapshot([]byte("de")); err == nil {
+		t.Error("empty dictionary decoded")
+	}
+
+	// Malformed nodes are skipped
+	buckets := []bucketSnapshot{{Nodes: []nodeSnapshot{
+		{ID: "short", Addr: "\x01\x02\x03\x04\x1a\xe1"},
+		{ID: string(GenerateID()), Addr: "\x01\x02\x03"},
+		{ID: string(GenerateID()), Addr: "\x01\x02\x03\x04\x1a\xe1"},
+	}}}
+	if nodes := snapshotNodes(buckets); len(nodes) != 1 || nodes[0].Addr.String() != "1.2.3.4:6881" {
+		t.Errorf("restored %v", nodes)
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kademila")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot")
+	for _, data := range []string{"first", "second"} {
+		if err := writeFile(path, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := ioutil.ReadFile(path); string(got) != data {
+			t.Errorf("read %q, want %q", got, data)
+		}
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("%d files left, want 1", len(files))
+	}
+}
+
+func TestSaveConcurrently(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kademila")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := DefaultOptions()
+	opts.IdentityPath = filepath.Join(dir, "identity")
+	opts.SnapshotPath = filepath.Join(dir, "snapshot")
+	ctx := testContext(t, opts)
+	c, _ := FromContext(ctx)
+	c.identity = localIdentity(c)
+	k := &Kademila{ctx: ctx, routing: newTable(ctx, false), token: newTokenBuilder()}
+
+	// The main loop saves the snapshot while the caller closes the node
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 10; i++ {
+			k.saveSnapshot()
+			k.saveIdentity()
+		}
+		close(done)
+	}()
+	for i := 0; i < 10; i++ {
+		if err := k.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+	<-done
+	if _, err := loadIdentity(opts.IdentityPath); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCloseSavesBoth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kademila")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := DefaultOptions()
+	opts.IdentityPath = filepath.Join(dir, "identity")
+	opts.SnapshotPath = filepath.Join(dir, "snapshot")
+	ctx := testContext(t, opts)
+	c, _ := FromContext(ctx)
+	c.identity = localIdentity(c)
+	k := &Kademila{ctx: ctx, routing: newTable(ctx, false), token: newTokenBuilder()}
+
+	// The identity can no longer be written, the snapshot still is
+	os.Remove(opts.IdentityPath)
+	os.Mkdir(opts.IdentityPath, 0700)
+	ioutil.WriteFile(filepath.Join(opts.IdentityPath, "keep"), nil, 0600)
+	err = k.Close()
+	if serr, ok := err.(*SaveError); !ok || serr.Path != opts.IdentityPath {
+		t.Errorf("got %v, want the identity save failure", err)
+	}
+	if _, err := os.Stat(opts.SnapshotPath); err != nil {
+		t.Errorf("snapshot not saved: %v", err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"math/big"
 	"math/rand"
+	"net"
 	"sort"
 	"sync"
 	"time"
@@ -17,18 +18,37 @@ type bucket struct {
 	max         *big.Int
 	nodes       []Node
 	lastUpdated time.Time
+	// Recently seen nodes which did not fit, the freshest last
+	replacements []Node
+	// Nodes of the bucket by subnet
+	subnets map[string]int
+	// Nodes of the whole table by IP and subnet, shared by its buckets
+	addrs *addrCounts
 }
 
-func newBucket(ctx context.Context, min, max *big.Int) *bucket {
+func newBucket(ctx context.Context, min, max *big.Int, addrs *addrCounts) *bucket {
 	b := new(bucket)
 	b.ctx = ctx
 	b.min = min
 	b.max = max
 	b.nodes = make([]Node, 0, K)
 	b.lastUpdated = time.Now()
+	b.subnets = make(map[string]int)
+	b.addrs = addrs
 	return b
 }
 
+// count adds delta to the counters of the address of node.
+func (b *bucket) count(node *Node, delta int) {
+	ip := net.IP(node.IP())
+	sn := subnet(ip)
+	b.subnets[sn] += delta
+	if b.subnets[sn] <= 0 {
+		delete(b.subnets, sn)
+	}
+	b.addrs.add(ip, sn, delta)
+}
+
 func (b *bucket) generateRandomID() NodeID {
 	d := big.NewInt(0).Sub(b.max, b.min)
 	random := rand.New(rand.NewSource(time.Now().UnixNano()))
@@ -50,25 +70,91 @@ func (b *bucket) len() int {
 	return len(b.nodes)
 }
 
+// capacity returns the number of nodes b holds, K unless Options.BucketSizes
+// gives it more room. The bucket covering our ID local takes the size of the
+// half it will split off.
+func (b *bucket) capacity(local *big.Int) int {
+	c, _ := FromContext(b.ctx)
+	size := big.NewInt(0).Sub(b.max, b.min)
+	shared := MaxBitsLength + 1 - size.BitLen()
+	if b.compare(local) != 0 {
+		shared--
+	}
+	sizes := c.Options.BucketSizes
+	if shared < len(sizes) && sizes[shared] > K {
+		return sizes[shared]
+	}
+	return K
+}
+
 func (b *bucket) getInsertPosition(newnode *big.Int) int {
 	return sort.Search(len(b.nodes), func(i int) bool {
 		return b.nodes[i].ID.Int().Cmp(newnode) >= 0
 	})
 }
 
+// leastRecentlySeen returns the questionable or bad node of b which we have
+// not heard from for the longest time, skipping those in exclude.
+func (b *bucket) leastRecentlySeen(exclude map[string]bool) *Node {
+	var oldest *Node
+	for i := range b.nodes {
+		n := &b.nodes[i]
+		if n.Status == GOOD || exclude[n.ID.String()] {
+			continue
+		}
+		if oldest == nil || n.LastSeen.Before(oldest.LastSeen) {
+			oldest = n
+		}
+	}
+	return oldest
+}
+
+// bad returns the bad node of b which failed the most queries, nil if all
+// are good or questionable.
+func (b *bucket) bad() *Node {
+	var worst *Node
+	for i := range b.nodes {
+		n := &b.nodes[i]
+		if n.Status == BAD && (worst == nil || n.Failures > worst.Failures) {
+			worst = n
+		}
+	}
+	return worst
+}
+
+// updateStatus applies the status rules to the nodes of bucket idx.
+func (t *table) updateStatus(idx int, now time.Time) {
+	b := t.buckets[idx]
+	for i := range b.nodes {
+		old := b.nodes[i].Status
+		b.nodes[i].updateStatus(now)
+		if b.nodes[i].Status != old {
+			t.emit(NodeStatusChanged, &b.nodes[i], idx)
+		}
+	}
+}
+
+func (b *bucket) has(node *Node) bool {
+	i := b.getInsertPosition(node.ID.Int())
+	return i < len(b.nodes) && b.nodes[i].ID.Int().Cmp(node.ID.Int()) == 0
+}
+
 func (b *bucket) addNode(newnode *Node) {
-	b.lastUpdated = time.Now()
+	now := time.Now()
+	b.lastUpdated = now
 	i := b.getInsertPosition(newnode.ID.Int())
 	if i < len(b.nodes) && b.nodes[i].ID.Int().Cmp(newnode.ID.Int()) == 0 {
-		b.nodes[i].LastSeen = time.Now()
-		b.nodes[i].Status = GOOD
-		if b.nodes[i].Addr != newnode.Addr {
-			b.nodes[i].Addr = newnode.Addr
-		}
+		b.count(&b.nodes[i], -1)
+		b.nodes[i].LastSeen = now
+		b.nodes[i].merge(newnode)
+		b.nodes[i].updateStatus(now)
+		b.count(&b.nodes[i], 1)
 		return
 	}
-	newnode.LastSeen = time.Now()
-	newnode.Status = GOOD
+	b.deleteReplacement(newnode)
+	b.count(newnode, 1)
+	newnode.LastSeen = now
+	newnode.updateStatus(now)
 	if i < len(b.nodes) {
 		b.nodes = append(b.nodes, Node{})
 		copy(b.nodes[i+1:], b.nodes[i:])
@@ -81,6 +167,7 @@ func (b *bucket) addNode(newnode *Node) {
 func (b *bucket) deleteNode(node *Node) {
 	i := b.getInsertPosition(node.ID.Int())
 	if i < len(b.nodes) && b.nodes[i].ID.Int().Cmp(node.ID.Int()) == 0 {
+		b.count(&b.nodes[i], -1)
 		var newnodes []Node
 		for j := range b.nodes {
 			if j != i {
@@ -91,6 +178,54 @@ func (b *bucket) deleteNode(node *Node) {
 	}
 }
 
+// addReplacement caches newnode for when a node of the full bucket goes bad,
+// the oldest candidate is dropped once there are ReplacementCacheSize.
+func (b *bucket) addReplacement(newnode *Node) {
+	b.deleteReplacement(newnode)
+	n := *newnode
+	n.LastSeen = time.Now()
+	n.updateStatus(n.LastSeen)
+	b.replacements = append(b.replacements, n)
+	if len(b.replacements) > ReplacementCacheSize {
+		b.replacements = b.replacements[1:]
+	}
+}
+
+func (b *bucket) deleteReplacement(node *Node) {
+	for i := range b.replacements {
+		if b.replacements[i].ID.String() == node.ID.String() {
+			b.replacements = append(b.replacements[:i], b.replacements[i+1:]...)
+			return
+		}
+	}
+}
+
+// promote moves the freshest replacement into the bucket, it returns false
+// if the bucket is full or there is no candidate.
+func (b *bucket) promote(local *big.Int) (Node, bool) {
+	if b.len() >= b.capacity(local) || len(b.replacements) == 0 {
+		return Node{}, false
+	}
+	last := len(b.replacements) - 1
+	n := b.replacements[last]
+	b.replacements = b.replacements[:last]
+	seen := n.LastSeen
+	b.addNode(&n)
+	b.nodes[b.getInsertPosition(n.ID.Int())].LastSeen = seen
+	return n, true
+}
+
+// insecure returns a node of b whose ID is not BEP 42 compliant, nil if
+// there is none.
+func (b *bucket) insecure() *Node {
+	for i := range b.nodes {
+		if !VerifyID(b.nodes[i].ID, net.IP(b.nodes[i].IP())) {
+			return &b.nodes[i]
+		}
+	}
+	return nil
+}
+
 func (b *bucket) split() *bucket {
 	min := big.NewInt(0)
 	min.Add(b.max, b.min)
@@ -102,15 +237,33 @@ func (b *bucket) split() *bucket {
 	nb.max = b.max
 	b.max = min
 	nb.lastUpdated = b.lastUpdated
+	nb.subnets = make(map[string]int)
+	nb.addrs = b.addrs
 
 	i := b.getInsertPosition(nb.min)
+	nb.nodes = make([]Node, 0, K)
 	if i < b.len() {
-		nb.nodes = make([]Node, len(b.nodes[i:]), K)
-		copy(nb.nodes, b.nodes[i:])
+		nb.nodes = append(nb.nodes, b.nodes[i:]...)
 		b.nodes = b.nodes[0:i]
-	} else {
-		nb.nodes = make([]Node, 0, K)
 	}
+	// The nodes only move between buckets, the table counts stay the same
+	for j := range nb.nodes {
+		sn := subnet(net.IP(nb.nodes[j].IP()))
+		nb.subnets[sn]++
+		if b.subnets[sn]--; b.subnets[sn] <= 0 {
+			delete(b.subnets, sn)
+		}
+	}
+
+	var replacements []Node
+	for _, n := range b.replacements {
+		if nb.compare(n.ID.Int()) == 0 {
+			nb.replacements = append(nb.replacements, n)
+		} else {
+			replacements = append(replacements, n)
+		}
+	}
+	b.replacements = replacements
 	return nb
 }
 
@@ -119,7 +272,7 @@ func (b *bucket) String() string {
 	buf := bytes.NewBuffer(nil)
 	buf.WriteString(fmt.Sprintf("[%x, %x), ", b.min.Bytes(), b.max.Bytes()))
 	for i, n := range b.nodes {
-		buf.WriteString(fmt.Sprintf("<%d, ID=%s, Addr=%s, S=%s, D=%d>", i, n.ID.HexString(), n.Addr.String(), n.SStatus(), Distance(n.ID, c.Local.ID)))
+		buf.WriteString(fmt.Sprintf("<%d, ID=%s, Addr=%s, S=%s, D=%d>", i, n.ID.HexString(), n.Addr.String(), n.SStatus(), Distance(n.ID, c.LocalID())))
 		if i < b.len() {
 			buf.WriteString("; ")
 		}
@@ -129,29 +282,59 @@ func (b *bucket) String() string {
 
 type table struct {
 	ctx        context.Context
+	ipv6       bool
 	lock       *sync.Mutex
 	buckets    []*bucket
 	finderLock *sync.Mutex
 	finders    []*finder
+	lookups    map[int]*finder
+	lookupSeq  int
+	// Nodes being pinged before they are evicted for a newcomer
+	challenged map[string]bool
+	// Nodes turned away by the diversity limits, by limit
+	rejected map[string]uint64
+	// Nodes by IP and subnet, for the diversity limits
+	addrs *addrCounts
+	// Our ID the buckets are split around, it only follows the node ID on
+	// rebuild
+	local *big.Int
+	// Subscribers of the changes, nil if there are none
+	events *eventHub
 }
 
-func newTable(ctx context.Context) *table {
+func newTable(ctx context.Context, ipv6 bool) *table {
 	t := new(table)
 	t.ctx = ctx
+	t.ipv6 = ipv6
 	t.lock = new(sync.Mutex)
 	t.finderLock = new(sync.Mutex)
+	t.lookups = make(map[int]*finder)
+	t.challenged = make(map[string]bool)
+	t.rejected = make(map[string]uint64)
+	t.addrs = newAddrCounts()
+	c, _ := FromContext(ctx)
+	t.local = c.LocalID().Int()
 
 	min := big.NewInt(0)
 	max := big.NewInt(1)
 	max.Lsh(max, MaxBitsLength)
-	t.buckets = append(t.buckets, newBucket(ctx, min, max))
+	t.buckets = append(t.buckets, newBucket(ctx, min, max, t.addrs))
 
 	for i := 0; i < FinderNum; i++ {
-		t.finders = append(t.finders, newFinder(ctx, i))
+		t.finders = append(t.finders, newFinder(ctx, i, ipv6))
 	}
 	return t
 }
 
+// bootstrapNodes returns the bootstrap nodes of the table's address family.
+func (t *table) bootstrapNodes() []Node {
+	c, _ := FromContext(t.ctx)
+	if t.ipv6 {
+		return c.bootstrap6
+	}
+	return c.bootstrap
+}
+
 func (t *table) searchBucket(key *big.Int) int {
 	return sort.Search(len(t.buckets), func(i int) bool {
 		return t.buckets[i].max.Cmp(key) > 0
@@ -159,54 +342,386 @@ func (t *table) searchBucket(key *big.Int) int {
 }
 
 func (t *table) addNode(newnode *Node) {
-	c, _ := FromContext(t.ctx)
-
 	t.lock.Lock()
 	defer t.lock.Unlock()
+	t.insert(newnode)
+}
+
+func (t *table) insert(newnode *Node) {
+	c, _ := FromContext(t.ctx)
 
-	if newnode.ID.String() == c.Local.ID.String() {
+	if newnode.ID.String() == c.LocalID().String() {
+		return
+	}
+	policy := c.Options.SecureIDPolicy
+	secure := policy == SecureIDIgnore || VerifyID(newnode.ID, net.IP(newnode.IP()))
+	if policy == SecureIDRequire && !secure {
+		c.Log.Debugf("Node %s rejected, ID is not BEP 42 compliant", newnode)
 		return
 	}
 
 	k := newnode.ID.Int()
 	idx := t.searchBucket(k)
 	bk := t.buckets[idx]
+	known := bk.has(newnode)
 	for {
-		if bk.len() < K {
+		if known {
+			n := &bk.nodes[bk.getInsertPosition(k)]
+			if newnode.Addr != nil && newnode.Addr.String() != n.Addr.String() {
+				// A known ID from another address is held to the limits
+				// of a newcomer, or anyone could move our nodes to theirs
+				bk.count(n, -1)
+				ok := t.admit(bk, newnode)
+				bk.count(n, 1)
+				if !ok {
+					break
+				}
+			}
+			old := n.Status
 			bk.addNode(newnode)
+			if n.Status != old {
+				t.emit(NodeStatusChanged, n, idx)
+			}
+			break
+		} else if bk.len() < bk.capacity(t.local) && !t.full() {
+			if t.admit(bk, newnode) {
+				bk.addNode(newnode)
+				t.emit(NodeAdded, newnode, idx)
+			}
 			break
-		} else if bk.compare(c.Local.ID.Int()) == 0 {
+		} else if bk.len() >= bk.capacity(t.local) && !t.full() && bk.compare(t.local) == 0 {
 			nbk := bk.split()
 			t.buckets = append(t.buckets, nil)
 			copy(t.buckets[idx+2:], t.buckets[idx+1:])
 			t.buckets[idx+1] = nbk
+			t.emit(BucketSplit, newnode, idx)
+			// The half covering our ID may be smaller than the bucket was
+			if nbk.compare(t.local) == 0 {
+				t.trim(idx + 1)
+			} else {
+				t.trim(idx)
+			}
 			if nbk.compare(k) == 0 {
 				idx = idx + 1
 				bk = nbk
 			}
 		} else {
-			// discard it
+			t.updateStatus(idx, time.Now())
+			// A bad node makes room, so does an insecure one if we prefer
+			// secure IDs
+			victim := bk.bad()
+			if victim == nil && policy == SecureIDPrefer && secure {
+				victim = bk.insecure()
+			}
+			if victim != nil {
+				if !t.admit(bk, newnode) {
+					break
+				}
+				old := *victim
+				c.Log.Debugf("Node %s evicted for %s, %d failures", old.ID.HexString(), newnode.ID.HexString(), old.Failures)
+				bk.deleteNode(&old)
+				t.emit(NodeEvicted, &old, idx)
+				bk.addNode(newnode)
+				t.emit(NodeAdded, newnode, idx)
+				break
+			}
+			// otherwise keep it for when a node goes bad, a node the
+			// table would turn away is not worth keeping
+			if t.diversity(bk, newnode) == "" {
+				bk.addReplacement(newnode)
+				t.challenge(idx, newnode)
+			}
 			break
 		}
 	}
 }
 
+// trim moves the nodes bucket idx holds beyond its capacity to its
+// replacement cache, the least recently seen questionable or bad ones first.
+func (t *table) trim(idx int) {
+	b := t.buckets[idx]
+	for b.len() > b.capacity(t.local) {
+		n := b.leastRecentlySeen(nil)
+		if n == nil {
+			n = &b.nodes[0]
+			for i := range b.nodes {
+				if b.nodes[i].LastSeen.Before(n.LastSeen) {
+					n = &b.nodes[i]
+				}
+			}
+		}
+		old := *n
+		b.deleteNode(&old)
+		b.addReplacement(&old)
+		t.emit(NodeEvicted, &old, idx)
+	}
+}
+
+// subnet returns the /24 of an IPv4 address or the /64 of an IPv6 one.
+func subnet(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// addrCounts counts the nodes of a table by IP and by subnet.
+type addrCounts struct {
+	ips     map[string]int
+	subnets map[string]int
+}
+
+func newAddrCounts() *addrCounts {
+	return &addrCounts{ips: make(map[string]int), subnets: make(map[string]int)}
+}
+
+// add adds delta to the counters of ip and its subnet sn.
+func (a *addrCounts) add(ip net.IP, sn string, delta int) {
+	key := string(ip.To16())
+	if a.ips[key] += delta; a.ips[key] <= 0 {
+		delete(a.ips, key)
+	}
+	if a.subnets[sn] += delta; a.subnets[sn] <= 0 {
+		delete(a.subnets, sn)
+	}
+}
+
+// admit applies the diversity limits to newnode joining bk, counting and
+// logging the rejection.
+func (t *table) admit(bk *bucket, newnode *Node) bool {
+	c, _ := FromContext(t.ctx)
+	limit := t.diversity(bk, newnode)
+	if limit == "" {
+		return true
+	}
+	t.rejected[limit]++
+	c.Log.Debugf("Node %s rejected, exceeds %s limit", newnode, limit)
+	return false
+}
+
+// diversity checks that adding newnode to bk keeps the table within
+// Options.MaxNodesPerIP, MaxNodesPerSubnetInBucket and MaxNodesPerSubnet. It
+// returns the name of the limit newnode exceeds, "" if there is none.
+func (t *table) diversity(bk *bucket, newnode *Node) string {
+	c, _ := FromContext(t.ctx)
+	opts := c.Options
+	ip := net.IP(newnode.IP())
+	if exemptIP(ip) {
+		return ""
+	}
+	sn := subnet(ip)
+	switch {
+	case opts.MaxNodesPerIP > 0 && t.addrs.ips[string(ip.To16())] >= opts.MaxNodesPerIP:
+		return "ip"
+	case opts.MaxNodesPerSubnetInBucket > 0 && bk.subnets[sn] >= opts.MaxNodesPerSubnetInBucket:
+		return "bucket-subnet"
+	case opts.MaxNodesPerSubnet > 0 && t.addrs.subnets[sn] >= opts.MaxNodesPerSubnet:
+		return "subnet"
+	}
+	return ""
+}
+
+// challenge pings the least recently seen questionable node of the full
+// bucket idx, newcomer waits in the replacement cache meanwhile. If the ping
+// times out the node is evicted and newcomer takes its place, otherwise
+// newcomer stays a replacement. Called with t.lock held.
+func (t *table) challenge(idx int, newcomer *Node) {
+	c, _ := FromContext(t.ctx)
+	n := t.buckets[idx].leastRecentlySeen(t.challenged)
+	if n == nil {
+		return
+	}
+	node := *n
+	challenger := *newcomer
+	t.challenged[node.ID.String()] = true
+	c.Log.Debugf("Bucket #%d is full, ping %s before evicting it", idx, node.ID.HexString())
+
+	go func() {
+		f, cancel := t.newLookup(t.ctx)
+		defer cancel()
+		defer t.releaseLookup(f)
+		nodes := f.pingNodes([]Node{node})
+
+		t.lock.Lock()
+		delete(t.challenged, node.ID.String())
+		t.lock.Unlock()
+		if nodes == nil {
+			return
+		}
+		if nodes[0].Status == BAD {
+			t.replace(&nodes[0], &challenger)
+		} else {
+			t.addNode(&nodes[0])
+		}
+	}()
+}
+
+// replace evicts node, which did not answer our ping, for newcomer. The
+// freshest replacement takes the slot if newcomer is not admitted.
+func (t *table) replace(node, newcomer *Node) {
+	c, _ := FromContext(t.ctx)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	idx := t.searchBucket(node.ID.Int())
+	bk := t.buckets[idx]
+	if !bk.has(node) {
+		return
+	}
+	bk.deleteNode(node)
+	t.emit(NodeEvicted, node, idx)
+	c.Log.Debugf("Node %s evicted for %s, ping timed out", node.ID.HexString(), newcomer.ID.HexString())
+	t.insert(newcomer)
+	if n, ok := bk.promote(t.local); ok {
+		t.emit(NodeAdded, &n, t.searchBucket(n.ID.Int()))
+	}
+}
+
+// rebuild redistributes all nodes into new buckets after the local ID
+// changed.
+func (t *table) rebuild() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var nodes, replacements []Node
+	for _, b := range t.buckets {
+		nodes = append(nodes, b.nodes...)
+		replacements = append(replacements, b.replacements...)
+	}
+	min := big.NewInt(0)
+	max := big.NewInt(1)
+	max.Lsh(max, MaxBitsLength)
+	c, _ := FromContext(t.ctx)
+	t.local = c.LocalID().Int()
+	t.addrs = newAddrCounts()
+	t.buckets = []*bucket{newBucket(t.ctx, min, max, t.addrs)}
+
+	for i := range nodes {
+		n := nodes[i]
+		t.insert(&n)
+	}
+	for i := range replacements {
+		n := replacements[i]
+		t.insert(&n)
+	}
+	// insert refreshes the nodes, restore what we knew
+	known := make(map[string]*Node)
+	for i := range nodes {
+		known[nodes[i].ID.String()] = &nodes[i]
+	}
+	for _, b := range t.buckets {
+		for i := range b.nodes {
+			if n, ok := known[b.nodes[i].ID.String()]; ok {
+				b.nodes[i].Status = n.Status
+				b.nodes[i].LastSeen = n.LastSeen
+			}
+		}
+	}
+}
+
+// failNode counts a query node left unanswered. Once the node turns bad it is
+// evicted if the bucket has a replacement, otherwise it is the first to go
+// when a new node arrives.
+func (t *table) failNode(node *Node) {
+	c, _ := FromContext(t.ctx)
+	if len(node.ID) == 0 {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	idx := t.searchBucket(node.ID.Int())
+	b := t.buckets[idx]
+	i := b.getInsertPosition(node.ID.Int())
+	if i >= b.len() || !bytes.Equal(b.nodes[i].ID, node.ID) {
+		return
+	}
+	n := &b.nodes[i]
+	old := n.Status
+	n.Failures++
+	n.updateStatus(time.Now())
+	if n.Status != old {
+		t.emit(NodeStatusChanged, n, idx)
+	}
+	if n.Status != BAD || len(b.replacements) == 0 {
+		return
+	}
+	bad := *n
+	b.deleteNode(&bad)
+	t.emit(NodeEvicted, &bad, idx)
+	if r, ok := b.promote(t.local); ok {
+		t.emit(NodeAdded, &r, idx)
+		c.Log.Debugf("Node %s replaced by %s in bucket #%d, %d failures", bad.ID.HexString(), r.ID.HexString(), idx, bad.Failures)
+	}
+}
+
+// deleteNode removes a bad node and fills its slot from the replacement
+// cache of the bucket.
 func (t *table) deleteNode(node *Node) {
+	c, _ := FromContext(t.ctx)
 	t.lock.Lock()
 	defer t.lock.Unlock()
 	idx := t.searchBucket(node.ID.Int())
+	if !t.buckets[idx].has(node) {
+		return
+	}
 	t.buckets[idx].deleteNode(node)
+	t.emit(NodeEvicted, node, idx)
+	if n, ok := t.buckets[idx].promote(t.local); ok {
+		t.emit(NodeAdded, &n, idx)
+		c.Log.Debugf("Node %s replaced by %s in bucket #%d", node.ID.HexString(), n.ID.HexString(), idx)
+	}
 }
 
+// findNode returns the K good nodes closest to target, nearest first.
+// Questionable nodes fill in when there are not enough good ones, bad nodes
+// are never returned. The buckets are visited from the one covering target
+// outwards, so only the nodes of the nearest buckets are collected.
 func (t *table) findNode(target string) []Node {
+	var good, questionable []Node
 	t.lock.Lock()
-	defer t.lock.Unlock()
-	i := big.NewInt(0)
-	i.SetBytes([]byte(target))
-	idx := t.searchBucket(i)
-	ret := make([]Node, t.buckets[idx].len())
-	copy(ret, t.buckets[idx].nodes)
-	return ret
+	for _, idx := range t.bucketsByDistance(NodeID(target).Int()) {
+		b := t.buckets[idx]
+		for i := range b.nodes {
+			switch b.nodes[i].Status {
+			case GOOD:
+				good = append(good, b.nodes[i])
+			case QUESTIONABLE:
+				questionable = append(questionable, b.nodes[i])
+			}
+		}
+		if len(good) >= K {
+			break
+		}
+	}
+	t.lock.Unlock()
+
+	SortByDistance(NodeID(target), good)
+	if len(good) >= K {
+		return good[:K]
+	}
+	SortByDistance(NodeID(target), questionable)
+	if len(good)+len(questionable) > K {
+		questionable = questionable[:K-len(good)]
+	}
+	return append(good, questionable...)
+}
+
+// bucketsByDistance returns the indexes of the buckets, the one covering
+// target first and then by their XOR distance to it. A bucket is an aligned
+// range of IDs, every node in it is nearer to target than the nodes of the
+// buckets after it.
+func (t *table) bucketsByDistance(target *big.Int) []int {
+	dist := make([]*big.Int, len(t.buckets))
+	order := make([]int, len(t.buckets))
+	for i, b := range t.buckets {
+		bits := uint(big.NewInt(0).Sub(b.max, b.min).BitLen() - 1)
+		d := big.NewInt(0).Xor(b.min, target)
+		dist[i] = d.Rsh(d, bits).Lsh(d, bits)
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return dist[order[i]].Cmp(dist[order[j]]) < 0
+	})
+	return order
 }
 
 func (t *table) getFinder() *finder {
@@ -241,14 +756,13 @@ func (t *table) goPingNodes(finder *finder, queriedNodes []Node) {
 	finder.working.Store(true)
 	go func() {
 		defer finder.working.Store(false)
-		allnodes := finder.findNodes(c.Local.ID, queriedNodes)
+		// Failures are counted as the pings time out
+		nodes := finder.pingNodes(queriedNodes)
 		good := 0
-		for _, v := range allnodes {
-			if v.Status == GOOD {
+		for i := range nodes {
+			if nodes[i].Status == GOOD {
 				good++
-				t.addNode(v)
-			} else if v.Status == QUESTIONABLE {
-				t.deleteNode(v)
+				t.addNode(&nodes[i])
 			}
 		}
 		c.Log.Info(t)
@@ -260,17 +774,51 @@ func (t *table) bootstrap(target NodeID) {
 	t.finderLock.Lock()
 	defer t.finderLock.Unlock()
 
-	c, _ := FromContext(t.ctx)
 	finder := t.getFinder()
 	if finder != nil {
-		t.goFindNodes(finder, target, c.bootstrap)
+		t.goFindNodes(finder, target, t.bootstrapNodes())
 	}
 }
 
 func (t *table) forward(m *Message) {
 	if m.W >= 0 && m.W < len(t.finders) {
 		t.finders[m.W].forward(m)
+		return
 	}
+	t.finderLock.Lock()
+	f, ok := t.lookups[m.W]
+	t.finderLock.Unlock()
+	if ok {
+		f.forward(m)
+	}
+}
+
+// newLookup returns a dedicated finder for a caller driven lookup, it is
+// canceled together with ctx.
+func (t *table) newLookup(ctx context.Context) (*finder, context.CancelFunc) {
+	lctx, cancel := context.WithCancel(t.ctx)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-lctx.Done():
+		}
+	}()
+
+	t.finderLock.Lock()
+	defer t.finderLock.Unlock()
+	t.lookupSeq++
+	f := newFinder(lctx, FinderNum+t.lookupSeq, t.ipv6)
+	f.working.Store(true)
+	t.lookups[f.idx] = f
+	return f, cancel
+}
+
+func (t *table) releaseLookup(f *finder) {
+	t.finderLock.Lock()
+	defer t.finderLock.Unlock()
+	delete(t.lookups, f.idx)
+	f.working.Store(false)
 }
 
 func (t *table) check() {
@@ -297,22 +845,23 @@ func (t *table) check() {
 			if b.len() == 0 || diff.Minutes() >= BucketLastChangedTimeLimit {
 				c.Log.Infof("Begin refresh bucket #%d [%x, %x)", i, b.min.Bytes(), b.max.Bytes())
 				b.lastUpdated = now
-				queriedNodes := make([]Node, len(c.bootstrap))
-				copy(queriedNodes, c.bootstrap)
+				target := b.generateRandomID()
+				t.emit(BucketRefreshed, &Node{ID: target}, i)
+				bootstrap := t.bootstrapNodes()
+				queriedNodes := make([]Node, len(bootstrap))
+				copy(queriedNodes, bootstrap)
 				for j := range b.nodes {
 					queriedNodes = append(queriedNodes, b.nodes[j])
 				}
-				t.goFindNodes(finder, b.generateRandomID(), queriedNodes)
+				t.goFindNodes(finder, target, queriedNodes)
 				return
 			}
 		}
 		var ret []Node
-		for _, b := range t.buckets {
+		for idx, b := range t.buckets {
+			t.updateStatus(idx, now)
 			for i := range b.nodes {
-				ndiff := now.Sub(b.nodes[i].LastSeen)
-				if ndiff.Seconds() >= NodeRefreshnessTimeLimit {
-					b.nodes[i].Status = QUESTIONABLE
-					b.nodes[i].LastSeen = now
+				if b.nodes[i].Status != GOOD && !t.challenged[b.nodes[i].ID.String()] {
 					ret = append(ret, b.nodes[i])
 				}
 			}
@@ -323,6 +872,60 @@ func (t *table) check() {
 	}
 }
 
+// rejections returns the number of nodes turned away by each diversity
+// limit.
+func (t *table) rejections() map[string]uint64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ret := make(map[string]uint64)
+	for limit, n := range t.rejected {
+		ret[limit] = n
+	}
+	return ret
+}
+
+// RoutingTable is a copy of a routing table taken by Kademila.RoutingTable,
+// later changes of the table do not show in it.
+type RoutingTable struct {
+	IPv6    bool
+	Size    int
+	Buckets []RoutingBucket
+}
+
+// RoutingBucket covers the IDs in [Min, Max).
+type RoutingBucket struct {
+	Min         *big.Int
+	Max         *big.Int
+	LastChanged time.Time
+	Nodes       []Node
+}
+
+func (t *table) routingTable() *RoutingTable {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	rt := &RoutingTable{IPv6: t.ipv6, Size: t.len()}
+	for _, b := range t.buckets {
+		rb := RoutingBucket{
+			Min:         big.NewInt(0).Set(b.min),
+			Max:         big.NewInt(0).Set(b.max),
+			LastChanged: b.lastUpdated,
+			Nodes:       make([]Node, 0, b.len()),
+		}
+		for i := range b.nodes {
+			rb.Nodes = append(rb.Nodes, *b.nodes[i].Clone())
+		}
+		rt.Buckets = append(rt.Buckets, rb)
+	}
+	return rt
+}
+
+// full reports whether the table reached Options.MaxTableSize.
+func (t *table) full() bool {
+	c, _ := FromContext(t.ctx)
+	return c.Options.MaxTableSize > 0 && t.len() >= c.Options.MaxTableSize
+}
+
 func (t *table) len() int {
 	l := 0
 	for i := range t.buckets {
@@ -334,7 +937,7 @@ func (t *table) len() int {
 func (t *table) String() string {
 	c, _ := FromContext(t.ctx)
 	buf := bytes.NewBuffer(nil)
-	buf.WriteString(fmt.Sprintf("Local: %s, table: \n", c.Local))
+	buf.WriteString(fmt.Sprintf("Local: %s, table: \n", c.LocalID().HexString()))
 	for i, v := range t.buckets {
 		buf.WriteString(fmt.Sprintf("[%d]: time=%s, len=%d %v\n",
 			i, v.lastUpdated.Format(time.RFC822), v.len(), v.String()))
@@ -0,0 +1,509 @@
+package kademila
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// testContext returns a node context with opts which sends nothing, the
+// queries of the routing table pile up in Outgoing.
+func testContext(t *testing.T, opts *Options) context.Context {
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	c := &NodeContext{Log: logger, Options: copyOptions(opts)}
+	c.Outgoing = make(chan *Message, 1000)
+	c.Local.ID = GenerateID()
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), contextKey, c))
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// testNode returns a node with a random ID and the i-th private address,
+// good if it answered a query.
+func testNode(i int, good bool) *Node {
+	n := &Node{ID: GenerateID(), Addr: &net.UDPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 6881}}
+	if good {
+		n.LastResponse = time.Now()
+	}
+	return n
+}
+
+// closestByScan is findNode over all the nodes of the table.
+func closestByScan(tb *table, target NodeID) []Node {
+	var good, questionable []Node
+	for _, b := range tb.buckets {
+		for _, n := range b.nodes {
+			switch n.Status {
+			case GOOD:
+				good = append(good, n)
+			case QUESTIONABLE:
+				questionable = append(questionable, n)
+			}
+		}
+	}
+	SortByDistance(target, good)
+	SortByDistance(target, questionable)
+	all := append(good, questionable...)
+	if len(all) > K {
+		all = all[:K]
+	}
+	return all
+}
+
+func TestFindNode(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes int
+		// Every n-th node is good
+		every int
+	}{
+		{"all good", 500, 1},
+		{"mostly questionable", 500, 7},
+		{"few good", 200, 50},
+		{"none good", 100, 1000},
+		{"small", 5, 1},
+	}
+	for _, test := range tests {
+		ctx := testContext(t, nil)
+		c, _ := FromContext(ctx)
+		tb := newTable(ctx, false)
+		for i := 1; i <= test.nodes; i++ {
+			tb.addNode(testNode(i, i%test.every == 0))
+		}
+		tb.lock.Lock()
+		targets := []NodeID{GenerateID(), GenerateID(), c.LocalID(), tb.buckets[0].nodes[0].ID}
+		for _, target := range targets {
+			want := closestByScan(tb, target)
+			tb.lock.Unlock()
+			got := tb.findNode(target.String())
+			tb.lock.Lock()
+			if len(got) != len(want) {
+				t.Errorf("%s: %d nodes, want %d", test.name, len(got), len(want))
+				continue
+			}
+			for i := range got {
+				if got[i].ID.String() != want[i].ID.String() {
+					t.Errorf("%s: node %d is %x, want %x", test.name, i, got[i].ID, want[i].ID)
+					break
+				}
+			}
+		}
+		tb.lock.Unlock()
+	}
+}
+
+// farID returns a random ID in the half of the ID space without localID.
+func farID(localID NodeID) NodeID {
+	id := GenerateID()
+	id[0] = id[0]&0x7f | ^localID[0]&0x80
+	return id
+}
+
+// waitFor polls cond until it holds or a second passed.
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+func TestChallenge(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		// The pinged node is replaced by the newcomer
+		evicted bool
+	}{
+		{"response", "r", false},
+		{"error", "e", false},
+		{"timeout", YTimeout, true},
+	}
+	for _, test := range tests {
+		ctx := testContext(t, nil)
+		c, _ := FromContext(ctx)
+		tb := newTable(ctx, false)
+		for i := 1; i <= K; i++ {
+			n := testNode(i, false)
+			n.ID = farID(c.LocalID())
+			tb.addNode(n)
+		}
+		newcomer := testNode(K+1, true)
+		newcomer.ID = farID(c.LocalID())
+		tb.addNode(newcomer)
+
+		var ping *Message
+		select {
+		case ping = <-c.Outgoing:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: no ping sent", test.name)
+		}
+		if ping.Q != "ping" {
+			t.Fatalf("%s: sent %s, want ping", test.name, ping.Q)
+		}
+		// A fresher replacement must not jump ahead of the newcomer
+		later := testNode(K+2, true)
+		later.ID = farID(c.LocalID())
+		tb.addNode(later)
+
+		reply := &Message{Y: test.reply, Q: "ping", W: ping.W, N: ping.N}
+		switch test.reply {
+		case "r":
+			reply.A = &PingResponse{ID: ping.N.ID.String()}
+		case "e":
+			reply.A = &Err{GenericError, ErrorDefinitions[GenericError]}
+		}
+		tb.forward(reply)
+
+		has := func(n *Node) bool {
+			tb.lock.Lock()
+			defer tb.lock.Unlock()
+			return tb.buckets[tb.searchBucket(n.ID.Int())].has(n)
+		}
+		if test.evicted {
+			if !waitFor(func() bool { return has(newcomer) }) {
+				t.Errorf("%s: newcomer not inserted", test.name)
+			}
+			if has(&ping.N) || has(later) {
+				t.Errorf("%s: pinged node not evicted for the newcomer", test.name)
+			}
+			continue
+		}
+		answered := func() bool {
+			tb.lock.Lock()
+			defer tb.lock.Unlock()
+			b := tb.buckets[tb.searchBucket(ping.N.ID.Int())]
+			i := b.getInsertPosition(ping.N.ID.Int())
+			return i < b.len() && !b.nodes[i].LastResponse.IsZero()
+		}
+		if !waitFor(answered) {
+			t.Errorf("%s: pinged node not kept", test.name)
+		}
+		if has(newcomer) {
+			t.Errorf("%s: newcomer inserted", test.name)
+		}
+	}
+}
+
+// checkAddrCounts compares the address counters of tb with its nodes.
+func checkAddrCounts(t *testing.T, name string, tb *table) {
+	want := newAddrCounts()
+	for _, b := range tb.buckets {
+		subnets := make(map[string]int)
+		for _, n := range b.nodes {
+			ip := net.IP(n.IP())
+			want.add(ip, subnet(ip), 1)
+			subnets[subnet(ip)]++
+		}
+		if !reflect.DeepEqual(b.subnets, subnets) {
+			t.Errorf("%s: bucket counts %v, want %v", name, b.subnets, subnets)
+		}
+	}
+	if !reflect.DeepEqual(tb.addrs, want) {
+		t.Errorf("%s: table counts %v, want %v", name, tb.addrs, want)
+	}
+}
+
+func TestDiversity(t *testing.T) {
+	ctx := testContext(t, nil)
+	c, _ := FromContext(ctx)
+	c.Options.MaxNodesPerSubnetInBucket = 3
+	c.Options.MaxNodesPerSubnet = 5
+	tb := newTable(ctx, false)
+	var nodes []*Node
+	for i := 0; i < 300; i++ {
+		n := testNode(i, true)
+		// 30 public subnets of 10 addresses, every address used twice
+		n.Addr = &net.UDPAddr{IP: net.IPv4(1, 2, byte(i%30), byte(i/30%5)), Port: 6881}
+		nodes = append(nodes, n)
+		tb.addNode(n)
+	}
+	checkAddrCounts(t, "insert", tb)
+	for ip, n := range tb.addrs.ips {
+		if n > 1 {
+			t.Errorf("%d nodes with %v", n, net.IP(ip))
+		}
+	}
+	for sn, n := range tb.addrs.subnets {
+		if n > 5 {
+			t.Errorf("%d nodes in %s", n, sn)
+		}
+	}
+	for _, b := range tb.buckets {
+		for sn, n := range b.subnets {
+			if n > 3 {
+				t.Errorf("%d nodes in %s in one bucket", n, sn)
+			}
+		}
+	}
+
+	// Nodes moving to another address
+	tb.lock.Lock()
+	for _, b := range tb.buckets {
+		for i := range b.nodes {
+			n := b.nodes[i]
+			n.Addr = &net.UDPAddr{IP: net.IPv4(5, 6, byte(i), byte(len(b.nodes))), Port: 6881}
+			tb.insert(&n)
+		}
+	}
+	tb.lock.Unlock()
+	checkAddrCounts(t, "address change", tb)
+
+	for _, n := range nodes[:50] {
+		tb.deleteNode(n)
+	}
+	checkAddrCounts(t, "delete", tb)
+
+	c.setLocalID(GenerateID())
+	tb.rebuild()
+	checkAddrCounts(t, "rebuild", tb)
+}
+
+func TestDiversityAddressChange(t *testing.T) {
+	ctx := testContext(t, nil)
+	tb := newTable(ctx, false)
+	var nodes []*Node
+	for i := 0; i < 100; i++ {
+		n := testNode(i, true)
+		n.Addr = &net.UDPAddr{IP: net.IPv4(1, byte(i), 1, 1), Port: 6881}
+		nodes = append(nodes, n)
+		tb.addNode(n)
+	}
+	// One address pinging us with the IDs of our nodes
+	attacker := net.IPv4(6, 6, 6, 6)
+	for i, n := range nodes {
+		spoofed := &Node{ID: n.ID, Addr: &net.UDPAddr{IP: attacker, Port: 1000 + i}, LastQuery: time.Now()}
+		tb.addNode(spoofed)
+	}
+	taken := 0
+	for _, b := range tb.buckets {
+		for _, n := range b.nodes {
+			if net.IP(n.IP()).Equal(attacker) {
+				taken++
+			}
+		}
+	}
+	if max := DefaultOptions().MaxNodesPerIP; taken > max {
+		t.Errorf("%d nodes moved to one address, want at most %d", taken, max)
+	}
+	if r := tb.rejections(); r["ip"] == 0 {
+		t.Errorf("rejections %v, want ip", r)
+	}
+	checkAddrCounts(t, "takeover", tb)
+
+	// A node may still move to a free address
+	var n Node
+	for _, n = range tb.buckets[0].nodes {
+		if !net.IP(n.IP()).Equal(attacker) {
+			break
+		}
+	}
+	tb.addNode(&Node{ID: n.ID, Addr: &net.UDPAddr{IP: net.IPv4(7, 7, 7, 7), Port: 6881}})
+	tb.lock.Lock()
+	b := tb.buckets[tb.searchBucket(n.ID.Int())]
+	moved := b.nodes[b.getInsertPosition(n.ID.Int())].Addr.String()
+	tb.lock.Unlock()
+	if moved != "7.7.7.7:6881" {
+		t.Errorf("node at %s, want 7.7.7.7:6881", moved)
+	}
+	checkAddrCounts(t, "move", tb)
+}
+
+func TestDiversityRejections(t *testing.T) {
+	ctx := testContext(t, nil)
+	c, _ := FromContext(ctx)
+	tb := newTable(ctx, false)
+	for i := 1; i <= K; i++ {
+		n := testNode(i, true)
+		n.ID = farID(c.LocalID())
+		n.Addr = &net.UDPAddr{IP: net.IPv4(1, 2, byte(i), 1), Port: 6881}
+		tb.addNode(n)
+	}
+	// The far bucket is full of good nodes, a newcomer could only be a
+	// replacement
+	n := testNode(0, true)
+	n.ID = farID(c.LocalID())
+	n.Addr = &net.UDPAddr{IP: net.IPv4(1, 2, 1, 1), Port: 6882}
+	tb.addNode(n)
+	if r := tb.rejections(); len(r) != 0 {
+		t.Errorf("replacement counted as rejected, %v", r)
+	}
+	b := tb.buckets[tb.searchBucket(n.ID.Int())]
+	if len(b.replacements) != 0 {
+		t.Error("node exceeding the limits kept as a replacement")
+	}
+
+	// Once a node is bad the newcomer would join the table
+	tb.lock.Lock()
+	b.nodes[0].Failures = MaxNodeFailures
+	tb.lock.Unlock()
+	tb.addNode(n)
+	if r := tb.rejections(); r["ip"] != 1 {
+		t.Errorf("rejections %v, want 1 ip", r)
+	}
+}
+
+func TestBucketCapacity(t *testing.T) {
+	opts := DefaultOptions()
+	opts.BucketSizes = []int{128, 64, 32, 16}
+	ctx := testContext(t, opts)
+	pow := func(n uint) *big.Int { return big.NewInt(0).Lsh(big.NewInt(1), n) }
+	// Our ID is 1, in the bucket at the lowest end of every split
+	local := big.NewInt(1)
+	tests := []struct {
+		name     string
+		min, max *big.Int
+		want     int
+	}{
+		{"whole space", big.NewInt(0), pow(160), 128},
+		{"far half", pow(159), pow(160), 128},
+		{"our half", big.NewInt(0), pow(159), 64},
+		{"second bucket", pow(158), pow(159), 64},
+		{"fourth bucket", pow(156), pow(157), 16},
+		{"ours after three splits", big.NewInt(0), pow(157), 16},
+		{"ours after four splits", big.NewInt(0), pow(156), K},
+		{"fifth bucket", pow(155), pow(156), K},
+		{"deep", big.NewInt(0), pow(10), K},
+	}
+	for _, test := range tests {
+		b := newBucket(ctx, test.min, test.max, newAddrCounts())
+		if got := b.capacity(local); got != test.want {
+			t.Errorf("%s: capacity %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBucketsWithinCapacity(t *testing.T) {
+	opts := DefaultOptions()
+	opts.BucketSizes = []int{128, 64, 32, 16}
+	opts.MaxTableSize = 200
+	// A split may leave the half covering our ID with twice its capacity,
+	// and once the table is full nothing splits it again. Try a few IDs.
+	for run := 0; run < 20; run++ {
+		tb := newTable(testContext(t, opts), false)
+		for i := 1; i <= 1000; i++ {
+			tb.addNode(testNode(i, true))
+		}
+		for i, b := range tb.buckets {
+			if b.len() > b.capacity(tb.local) {
+				t.Fatalf("bucket #%d of %d holds %d nodes, capacity %d", i, len(tb.buckets), b.len(), b.capacity(tb.local))
+			}
+		}
+		checkAddrCounts(t, "capacity", tb)
+	}
+}
+
+func TestTableLocalID(t *testing.T) {
+	ctx := testContext(t, nil)
+	c, _ := FromContext(ctx)
+	tb := newTable(ctx, false)
+	old := c.LocalID()
+	c.setLocalID(GenerateID())
+	if tb.local.Cmp(old.Int()) != 0 {
+		t.Error("buckets follow the new ID before the rebuild")
+	}
+	tb.rebuild()
+	if tb.local.Cmp(c.LocalID().Int()) != 0 {
+		t.Error("buckets still split around the old ID after the rebuild")
+	}
+}
+
+// checkRoutingTable verifies that the buckets of rt cover the ID space
+// without gaps and hold Size nodes, each in its own range, in order.
+func checkRoutingTable(t *testing.T, name string, rt *RoutingTable) {
+	size := 0
+	next := big.NewInt(0)
+	for i, b := range rt.Buckets {
+		if b.Min.Cmp(next) != 0 || b.Max.Cmp(b.Min) <= 0 {
+			t.Errorf("%s: bucket #%d covers [%x, %x) after %x", name, i, b.Min, b.Max, next)
+		}
+		next = b.Max
+		for j, n := range b.Nodes {
+			id := n.ID.Int()
+			if id.Cmp(b.Min) < 0 || id.Cmp(b.Max) >= 0 {
+				t.Errorf("%s: node %x out of bucket #%d", name, n.ID, i)
+			}
+			if j > 0 && b.Nodes[j-1].ID.Int().Cmp(id) >= 0 {
+				t.Errorf("%s: nodes of bucket #%d out of order", name, i)
+			}
+		}
+		size += len(b.Nodes)
+	}
+	if next.Cmp(big.NewInt(0).Lsh(big.NewInt(1), MaxBitsLength)) != 0 {
+		t.Errorf("%s: buckets end at %x", name, next)
+	}
+	if size != rt.Size {
+		t.Errorf("%s: %d nodes, Size %d", name, size, rt.Size)
+	}
+}
+
+func TestRoutingTable(t *testing.T) {
+	tests := []struct {
+		name  string
+		ipv6  bool
+		nodes int
+	}{
+		{"empty", false, 0},
+		{"IPv4", false, 300},
+		{"IPv6", true, 300},
+	}
+	for _, test := range tests {
+		ctx := testContext(t, nil)
+		tb := newTable(ctx, test.ipv6)
+		for i := 1; i <= test.nodes; i++ {
+			n := testNode(i, i%2 == 0)
+			if test.ipv6 {
+				n.Addr = &net.UDPAddr{IP: net.ParseIP(fmt.Sprintf("fd00::%x", i)), Port: 6881}
+			}
+			tb.addNode(n)
+		}
+		rt := tb.routingTable()
+		if rt.IPv6 != test.ipv6 || rt.Size != tb.len() || len(rt.Buckets) != len(tb.buckets) {
+			t.Errorf("%s: IPv6 %v, %d nodes in %d buckets", test.name, rt.IPv6, rt.Size, len(rt.Buckets))
+		}
+		checkRoutingTable(t, test.name, rt)
+
+		// The copy is not affected by later changes, nor the table by
+		// changes of the copy
+		if test.nodes == 0 {
+			continue
+		}
+		addrs := make(map[string]bool)
+		for _, b := range tb.buckets {
+			for _, n := range b.nodes {
+				addrs[n.Addr.String()] = true
+			}
+		}
+		for _, b := range rt.Buckets {
+			b.Min.SetInt64(1)
+			for i := range b.Nodes {
+				b.Nodes[i].ID[0] ^= 0xff
+				addr := b.Nodes[i].Addr.(*net.UDPAddr)
+				addr.IP[len(addr.IP)-1] ^= 0xff
+				addr.Port = 1
+			}
+		}
+		checkRoutingTable(t, test.name+" table", tb.routingTable())
+		for _, b := range tb.buckets {
+			for _, n := range b.nodes {
+				if !addrs[n.Addr.String()] {
+					t.Errorf("%s: address of the table changed to %s", test.name, n.Addr)
+				}
+			}
+		}
+		before := tb.routingTable()
+		for i := 1; i <= 10; i++ {
+			tb.addNode(testNode(test.nodes+i, true))
+		}
+		checkRoutingTable(t, test.name+" before changes", before)
+	}
+}
@@ -33,6 +33,18 @@ func (tk *TokenBuilder) renewToken() {
 	}
 }
 
+// secret returns the key of the tokens currently handed out.
+func (tk *TokenBuilder) secret() uint32 {
+	return tk.token
+}
+
+// setSecret makes key the current token key, as after a restart.
+func (tk *TokenBuilder) setSecret(key uint32) {
+	tk.token = key
+	tk.old = key
+	tk.lastUpdate = time.Now()
+}
+
 func (tk *TokenBuilder) create(ip string) string {
 	return string(tk.createHMac(ip, tk.token))
 }
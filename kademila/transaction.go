@@ -0,0 +1,189 @@
+package kademila
+
+import (
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// YTimeout is the `y` of the message reported to the sender of a query which
+// was not answered in time, it never goes on the wire.
+const YTimeout = "timeout"
+
+type transactionKey struct {
+	tid  string
+	addr string
+}
+
+// transaction is a query waiting for its response.
+type transaction struct {
+	q        string
+	w        int
+	node     Node
+	deadline time.Time
+	// Query callers wait here, nil for finder queries
+	done chan *Message
+}
+
+// transactionManager tracks the outstanding queries of one node. Responses
+// are matched on the transaction ID and the address the query was sent to,
+// queries left unanswered are expired after RequestTimeout.
+type transactionManager struct {
+	lock    sync.Mutex
+	pending map[transactionKey]*transaction
+	seq     uint16
+}
+
+func newTransactionManager() *transactionManager {
+	tm := new(transactionManager)
+	tm.pending = make(map[transactionKey]*transaction)
+	tm.seq = uint16(rand.Intn(1 << 16))
+	return tm
+}
+
+// start assigns m a transaction ID unique for its destination and records
+// it, the response or timeout is delivered to done if not nil.
+func (tm *transactionManager) start(m *Message, done chan *Message) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	addr := m.N.Addr.String()
+	bs := make([]byte, 2)
+	for {
+		tm.seq++
+		binary.BigEndian.PutUint16(bs, tm.seq)
+		if _, found := tm.pending[transactionKey{string(bs), addr}]; !found {
+			break
+		}
+	}
+	m.T = string(bs)
+	tm.pending[transactionKey{m.T, addr}] = &transaction{
+		q:        m.Q,
+		w:        m.W,
+		node:     m.N,
+		deadline: time.Now().Add(RequestTimeout * time.Second),
+		done:     done,
+	}
+}
+
+// get returns the query that tid from addr answers, nil if there is none.
+func (tm *transactionManager) get(tid string, addr net.Addr) *transaction {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	return tm.pending[transactionKey{tid, addr.String()}]
+}
+
+// finish closes the transaction answered by m and hands m to the waiting
+// Query caller.
+func (tm *transactionManager) finish(m *Message) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	key := transactionKey{m.T, m.N.Addr.String()}
+	tr, ok := tm.pending[key]
+	if !ok {
+		return
+	}
+	delete(tm.pending, key)
+	if tr.done != nil {
+		tr.done <- m
+	}
+}
+
+// cancel drops the transaction of m without delivering anything.
+func (tm *transactionManager) cancel(m *Message) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	delete(tm.pending, transactionKey{m.T, m.N.Addr.String()})
+}
+
+// expire removes the transactions past their deadline and returns their
+// timeout messages, which are also delivered to the waiting Query callers.
+func (tm *transactionManager) expire() []*Message {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+
+	now := time.Now()
+	var ret []*Message
+	for key, tr := range tm.pending {
+		if now.Before(tr.deadline) {
+			continue
+		}
+		delete(tm.pending, key)
+		m := &Message{
+			N: tr.node,
+			T: key.tid,
+			Y: YTimeout,
+			Q: tr.q,
+			W: tr.w,
+			A: TimeoutError{tr.q + " to " + key.addr},
+		}
+		if tr.done != nil {
+			tr.done <- m
+		}
+		ret = append(ret, m)
+	}
+	return ret
+}
+
+// run expires the transactions every second until ctx is done and hands the
+// timeout messages to timeout, away from the main loop.
+func (tm *transactionManager) run(ctx context.Context, timeout func(m *Message)) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, m := range tm.expire() {
+				timeout(m)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (tm *transactionManager) len() int {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	return len(tm.pending)
+}
+
+// Query sends the query msg to node and waits for the answer. An error reply
+// is returned together with its *Err, an unanswered query with TimeoutError.
+func (k *Kademila) Query(ctx context.Context, node Node, msg *Message) (*Message, error) {
+	if msg.Y != "q" {
+		return nil, ArgumentError{"Query needs a query message, got y=" + msg.Y}
+	}
+	if node.Addr == nil {
+		return nil, ArgumentError{"Query needs the address of node"}
+	}
+	c, _ := FromContext(k.ctx)
+	done := make(chan *Message, 1)
+	msg.N = node
+	msg.W = UndefinedWorker
+	k.transactions.start(msg, done)
+
+	select {
+	case c.Outgoing <- msg:
+	case <-ctx.Done():
+		k.transactions.cancel(msg)
+		return nil, ctx.Err()
+	}
+	select {
+	case m := <-done:
+		switch m.Y {
+		case "e":
+			return m, m.A.(*Err)
+		case YTimeout:
+			return nil, m.A.(TimeoutError)
+		}
+		return m, nil
+	case <-ctx.Done():
+		k.transactions.cancel(msg)
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,109 @@
+package kademila
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func testQuery(addr string, w int) *Message {
+	m := KRPCNewPing(GenerateID(), w)
+	udp, _ := net.ResolveUDPAddr("udp", addr)
+	m.N = Node{Addr: udp}
+	return m
+}
+
+func TestTransactionMatch(t *testing.T) {
+	tm := newTransactionManager()
+	a := testQuery("1.2.3.4:6881", 0)
+	b := testQuery("1.2.3.4:6881", 1)
+	c := testQuery("5.6.7.8:6881", 1)
+	for _, m := range []*Message{a, b, c} {
+		tm.start(m, nil)
+	}
+	if a.T == b.T {
+		t.Fatalf("same transaction ID %x for one address", a.T)
+	}
+
+	tests := []struct {
+		name string
+		tid  string
+		addr string
+		w    int
+		ok   bool
+	}{
+		{"first", a.T, "1.2.3.4:6881", 0, true},
+		{"second", b.T, "1.2.3.4:6881", 1, true},
+		{"other address", c.T, "5.6.7.8:6881", 1, true},
+		{"wrong port", a.T, "1.2.3.4:6882", 0, false},
+		{"wrong address", a.T, "9.9.9.9:6881", 0, false},
+		{"unknown tid", "zz", "1.2.3.4:6881", 0, false},
+	}
+	for _, test := range tests {
+		addr, _ := net.ResolveUDPAddr("udp", test.addr)
+		tr := tm.get(test.tid, addr)
+		if (tr != nil) != test.ok {
+			t.Errorf("%s: found %v, want %v", test.name, tr != nil, test.ok)
+			continue
+		}
+		if tr != nil && (tr.q != "ping" || tr.w != test.w) {
+			t.Errorf("%s: got %s of worker %d", test.name, tr.q, tr.w)
+		}
+	}
+}
+
+func TestTransactionFinish(t *testing.T) {
+	tm := newTransactionManager()
+	done := make(chan *Message, 1)
+	q := testQuery("1.2.3.4:6881", UndefinedWorker)
+	tm.start(q, done)
+
+	// A response from another address does not close it
+	r := testQuery("5.6.7.8:6881", UndefinedWorker)
+	r.T, r.Y = q.T, "r"
+	tm.finish(r)
+	if tm.len() != 1 || len(done) != 0 {
+		t.Fatalf("finished by the wrong address")
+	}
+
+	r = testQuery("1.2.3.4:6881", UndefinedWorker)
+	r.T, r.Y = q.T, "r"
+	tm.finish(r)
+	if tm.len() != 0 {
+		t.Errorf("%d pending after finish", tm.len())
+	}
+	if m := <-done; m != r {
+		t.Errorf("delivered %v, want the response", m)
+	}
+}
+
+func TestTransactionExpire(t *testing.T) {
+	tm := newTransactionManager()
+	done := make(chan *Message, 1)
+	old := testQuery("1.2.3.4:6881", 1)
+	fresh := testQuery("5.6.7.8:6881", 2)
+	tm.start(old, done)
+	tm.start(fresh, nil)
+	if ms := tm.expire(); len(ms) != 0 {
+		t.Fatalf("%d expired before the deadline", len(ms))
+	}
+
+	tm.pending[transactionKey{old.T, old.N.Addr.String()}].deadline = time.Now().Add(-time.Second)
+	ms := tm.expire()
+	if len(ms) != 1 {
+		t.Fatalf("%d expired, want 1", len(ms))
+	}
+	m := ms[0]
+	if m.Y != YTimeout || m.Q != "ping" || m.W != 1 || m.T != old.T || m.N.Addr.String() != "1.2.3.4:6881" {
+		t.Errorf("unexpected timeout message %+v", m)
+	}
+	if _, ok := m.A.(TimeoutError); !ok {
+		t.Errorf("A is %T, want TimeoutError", m.A)
+	}
+	if <-done != m {
+		t.Error("timeout not delivered to the waiting caller")
+	}
+	if tm.len() != 1 {
+		t.Errorf("%d pending, want 1", tm.len())
+	}
+}
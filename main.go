@@ -4,7 +4,10 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/sirupsen/logrus"
 	"github.com/zhujun1980/dhtrobot/kademila"
@@ -21,18 +24,49 @@ func initLogger() *logrus.Logger {
 }
 
 var (
-	flagClient bool
-	logLevel   int
+	flagClient   bool
+	flagReadOnly bool
+	flagSnapshot string
+	flagIdentity string
+	logLevel     int
 )
 
 func parseCommandLine() {
 	flag.BoolVar(&flagClient, "client", false, "Run program in client mode")
+	flag.BoolVar(&flagReadOnly, "readonly", false, "Run as a read-only DHT node (BEP 43)")
+	flag.StringVar(&flagIdentity, "identity", "", "File the node ID is kept in across runs, created if missing")
+	flag.StringVar(&flagSnapshot, "snapshot", "", "File the node ID and routing table are saved to and restored from")
 	flag.IntVar(&logLevel, "loglevel", int(logrus.InfoLevel), "Log level[Info, Debug]")
 	flag.Parse()
 }
 
+// newNode restores the node from the snapshot file if there is one.
+func newNode(ctx context.Context, master chan string, logger *logrus.Logger, opts *kademila.Options) *kademila.Kademila {
+	if flagSnapshot != "" {
+		var dht *kademila.Kademila
+		data, err := ioutil.ReadFile(flagSnapshot)
+		if err == nil {
+			dht, err = kademila.Restore(ctx, master, logger, opts, data)
+		}
+		if err == nil {
+			return dht
+		}
+		if !os.IsNotExist(err) {
+			logger.WithFields(logrus.Fields{
+				"err": err,
+			}).Warn("Restore failed, starting a new node")
+		}
+	}
+	dht, _ := kademila.New(ctx, master, logger, opts)
+	return dht
+}
+
 func main() {
 	parseCommandLine()
+	opts := kademila.DefaultOptions()
+	opts.ReadOnly = flagReadOnly
+	opts.SnapshotPath = flagSnapshot
+	opts.IdentityPath = flagIdentity
 
 	var (
 		ctx    context.Context
@@ -44,15 +78,27 @@ func main() {
 	master := make(chan string)
 
 	if flagClient {
-		kademila.RunClient(ctx, master, logger)
+		kademila.RunClient(ctx, master, logger, opts)
 	} else {
-		dht, _ := kademila.New(ctx, master, logger)
+		dht := newNode(ctx, master, logger, opts)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 		for {
 			select {
 			case msg := <-master:
 				fmt.Println(msg)
+			case <-signals:
+				cancel()
 			case <-ctx.Done():
-				dht.Close()
+				if err := dht.Close(); err != nil {
+					fields := logrus.Fields{
+						"err": err,
+					}
+					if serr, ok := err.(*kademila.SaveError); ok {
+						fields["file"] = serr.Path
+					}
+					logger.WithFields(fields).Error("Save on shutdown failed")
+				}
 				return
 			}
 		}